@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"restreamx/pkg/api"
+	"restreamx/pkg/mysql"
+	"restreamx/pkg/sqlstmt"
+)
+
+// Policies for a segment MySQL keeps rejecting.
+const (
+	poisonHalt       = "halt"
+	poisonQuarantine = "quarantine"
+)
+
+const (
+	minApplyBackoff = 100 * time.Millisecond
+	maxApplyBackoff = 30 * time.Second
+)
+
+// errBadSegment marks a segment that cannot be applied as it stands: its
+// checksum, payload or tables are wrong.
+var errBadSegment = errors.New("bad segment")
+
+// stuckState describes the segments the agent is retrying, by commit index.
+type stuckState struct {
+	mu   sync.Mutex
+	segs map[uint64]*stuckSegment
+}
+
+type stuckSegment struct {
+	since   time.Time
+	lastErr string
+}
+
+func (s *stuckState) set(seg *api.Segment, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.segs, seg.CommitIndex)
+		return
+	}
+	if s.segs == nil {
+		s.segs = map[uint64]*stuckSegment{}
+	}
+	st := s.segs[seg.CommitIndex]
+	if st == nil {
+		st = &stuckSegment{since: time.Now()}
+		s.segs[seg.CommitIndex] = st
+	}
+	st.lastErr = err.Error()
+}
+
+// get returns the commit index of the oldest segment being retried, how long
+// it has been failing in seconds and its last error, or zeros.
+func (s *stuckState) get() (uint64, float64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var index uint64
+	for ci := range s.segs {
+		if index == 0 || ci < index {
+			index = ci
+		}
+	}
+	if index == 0 {
+		return 0, 0, ""
+	}
+	st := s.segs[index]
+	return index, time.Since(st.since).Seconds(), st.lastErr
+}
+
+// process applies seg, retrying with backoff until it is applied, so the
+// checkpoints never pass it. A segment that fails -poison-attempts times for
+// a reason of its own is halted on, which keeps retrying it in case the cause
+// is fixed, or quarantined: recorded in rlr_meta.dead_letters and passed
+// over. Only failures once every earlier segment is applied count, since
+// until then the cause may be a row an earlier segment writes under another
+// key, through a unique index or a foreign key.
+func (a *agent) process(seg *api.Segment) {
+	backoff := minApplyBackoff
+	faults := 0
+	for attempt := 1; ; attempt++ {
+		err := a.applySegment(seg)
+		a.stuck.set(seg, err)
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("applied segment %d of %s after %d attempts", seg.CommitIndex, seg.RangeId, attempt)
+			}
+			return
+		}
+		if attempt == 1 && errors.Is(err, api.ErrChecksumMismatch) {
+			atomic.AddUint64(&a.rejects, 1)
+		}
+		if segmentFault(err) && a.sched.first(seg) {
+			faults++
+		}
+		switch {
+		case faults < a.poisonAfter:
+		case a.poison == poisonQuarantine:
+			qerr := a.quarantine(seg, err)
+			if qerr == nil {
+				atomic.AddUint64(&a.quarantined, 1)
+				a.stuck.set(seg, nil)
+				log.Printf("quarantined segment %d of %s: %v", seg.CommitIndex, seg.RangeId, err)
+				return
+			}
+			err = qerr
+		case faults == a.poisonAfter:
+			log.Printf("halted at segment %d of %s; fix the cause, or run with -poison=%s to pass over it", seg.CommitIndex, seg.RangeId, poisonQuarantine)
+		}
+		atomic.AddUint64(&a.retries, 1)
+		log.Printf("apply segment %d of %s, attempt %d: %v", seg.CommitIndex, seg.RangeId, attempt, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxApplyBackoff)
+	}
+}
+
+// segmentFault reports whether err is down to the segment itself rather
+// than to the connection, contention or the node's configuration, which are
+// retried for as long as they last.
+func segmentFault(err error) bool {
+	if errors.Is(err, errBadSegment) {
+		return true
+	}
+	var me *mysql.Error
+	if !errors.As(err, &me) || me.Retryable() {
+		return false
+	}
+	switch me.Number {
+	case mysql.CodeAccessDenied, mysql.CodeTableAccessDenied, mysql.CodeSpecificAccess, mysql.CodeBadDB, mysql.CodeOptionPrevents, mysql.CodeReadOnlyTxn:
+		return false
+	}
+	return true
+}
+
+// quarantine records seg and why it failed in rlr_meta.dead_letters.
+func (a *agent) quarantine(seg *api.Segment, cause error) error {
+	stmt := sqlstmt.DeadLetter(seg.RangeId, seg.CommitIndex, seg.Epoch, seg.TxnId, seg.PayloadType, seg.PayloadBytes, cause.Error())
+	_, err := a.db.Exec(context.Background(), stmt.SQL, stmt.Args...)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"restreamx/pkg/api"
+	"restreamx/pkg/sqlstmt"
+)
+
+// maxBatchBytes caps the payload bytes of one batch, whatever -batch-size.
+const maxBatchBytes = 4 << 20
+
+// readStream receives the segments of stream on a goroutine, so they can be
+// waited for together with the batch timer. The channel is closed once the
+// stream fails, after its error is sent; closing stop abandons it.
+func readStream(stream *api.SegmentStream, stop <-chan struct{}, buffer int) (<-chan *api.Segment, <-chan error) {
+	segs := make(chan *api.Segment, buffer)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(segs)
+		for {
+			seg, err := stream.Next()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case segs <- seg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return segs, errc
+}
+
+// applyBatch applies the segments of e in one transaction with their
+// applied_segments rows, leaving out those recorded there already, and with
+// the checkpoints they reach when no earlier segment is left to apply.
+func (a *agent) applyBatch(e *entry) error {
+	stmts := make([][]sqlstmt.Stmt, len(e.segs))
+	marks := make([]string, len(e.segs))
+	args := make([]any, 0, 3*len(e.segs))
+	for i, seg := range e.segs {
+		var err error
+		if stmts[i], err = a.segmentStmts(seg); err != nil {
+			return err
+		}
+		marks[i] = "(?, ?, ?)"
+		args = append(args, seg.RangeId, seg.Epoch, seg.TxnId)
+	}
+	ctx := context.Background()
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	// Naming whole primary keys locks just those rows.
+	res, err := tx.Query(ctx, "SELECT range_id, epoch, txn_id FROM "+sqlstmt.AppliedTable+" WHERE (range_id, epoch, txn_id) IN ("+strings.Join(marks, ", ")+") FOR UPDATE", args...)
+	if err != nil {
+		return err
+	}
+	type mark struct {
+		rangeID string
+		epoch   uint64
+		txnID   string
+	}
+	done := make(map[mark]bool, len(res.Rows))
+	for _, row := range res.Rows {
+		r, _ := row[0].(string)
+		ep, _ := row[1].(int64)
+		t, _ := row[2].(string)
+		done[mark{r, uint64(ep), t}] = true
+	}
+	var all []sqlstmt.Stmt
+	for i, seg := range e.segs {
+		if !done[mark{seg.RangeId, seg.Epoch, seg.TxnId}] {
+			all = append(all, stmts[i]...)
+		}
+	}
+	// Holding saveMu keeps an older checkpoint from being saved over these.
+	a.saveMu.Lock()
+	cps := a.batchCheckpoints(e)
+	if cps == nil {
+		a.saveMu.Unlock()
+	} else {
+		defer a.saveMu.Unlock()
+	}
+	for _, stmt := range append(all, cps...) {
+		if _, err := tx.Exec(ctx, stmt.SQL, stmt.Args...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	if e.saved = len(cps) > 0; e.saved {
+		atomic.StoreUint64(&a.saved, e.segs[len(e.segs)-1].CommitIndex)
+	}
+	return nil
+}
+
+// batchCheckpoints returns the checkpoint rows through e, with the stream
+// position, if every segment dispatched before it is applied, or nil. The
+// caller holds saveMu.
+func (a *agent) batchCheckpoints(e *entry) []sqlstmt.Stmt {
+	s := a.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 || s.queue[0] != e {
+		return nil
+	}
+	type position struct{ index, epoch uint64 }
+	reached := map[string]position{}
+	a.mu.Lock()
+	for _, seg := range e.segs {
+		p, ok := reached[seg.RangeId]
+		if !ok {
+			p.epoch = a.epochs[seg.RangeId]
+		}
+		reached[seg.RangeId] = position{seg.CommitIndex, max(p.epoch, seg.Epoch)}
+		delete(a.dirty, seg.RangeId)
+	}
+	a.mu.Unlock()
+	stmts := make([]sqlstmt.Stmt, 0, len(reached)+1)
+	for r, p := range reached {
+		stmts = append(stmts, sqlstmt.Checkpoint(r, p.index, p.epoch))
+	}
+	return append(stmts, sqlstmt.Checkpoint(sqlstmt.StreamRange, e.segs[len(e.segs)-1].CommitIndex, 0))
+}
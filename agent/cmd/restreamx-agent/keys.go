@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"restreamx/pkg/api"
+	"restreamx/pkg/sqlstmt"
+)
+
+// schemaTTL is how long a table definition read to tell rows apart is used
+// before it is read again, so that indexes added later are seen.
+const schemaTTL = time.Minute
+
+type cachedTable struct {
+	table  *sqlstmt.Table // nil if it could not be read
+	loaded time.Time
+}
+
+// keyTable returns the definition of table, or nil if it cannot be read.
+func (a *agent) keyTable(name string) *sqlstmt.Table {
+	a.schemaMu.Lock()
+	defer a.schemaMu.Unlock()
+	if c, ok := a.schemas[name]; ok && time.Since(c.loaded) < schemaTTL {
+		return c.table
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t, err := sqlstmt.LoadTable(ctx, a.db, a.dbName, name)
+	if err != nil {
+		log.Printf("read table %s: %v; its segments run alone", name, err)
+		t = nil
+	}
+	a.schemas[name] = cachedTable{table: t, loaded: time.Now()}
+	return t
+}
+
+// segmentKeys returns the rows seg writes, each as its table and key, or
+// barrier if they cannot be told apart from the rows of other segments: the
+// payload does not say, the table has unique or foreign keys besides its
+// primary key, or a key value is one whose equality under its column's type
+// and collation is not known here.
+func (a *agent) segmentKeys(seg *api.Segment) (keys []string, barrier bool) {
+	ops, err := sqlstmt.DecodePayload(seg.PayloadType, seg.PayloadBytes)
+	if err != nil {
+		return nil, true
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case "insert", "update", "delete":
+		default:
+			continue
+		}
+		if len(op.Key) == 0 {
+			return nil, true
+		}
+		t := a.keyTable(op.Table)
+		if t == nil || t.Unique || t.Related {
+			return nil, true
+		}
+		cols := make([]string, 0, len(op.Key))
+		for name, v := range op.Key {
+			c := t.Column(name)
+			if c == nil {
+				return nil, true
+			}
+			text, ok := keyText(c, v)
+			if !ok {
+				return nil, true
+			}
+			cols = append(cols, strings.ToLower(name)+"="+text)
+		}
+		sort.Strings(cols)
+		keys = append(keys, strings.ToLower(op.Table)+"\x00"+strings.Join(cols, "\x00"))
+	}
+	return keys, false
+}
+
+// keyText returns text that is the same for any two values of column c that
+// MySQL compares as equal, or false. Values it tells apart that MySQL does
+// not would let two writes of one row run at once; the reverse only makes
+// segments wait.
+func keyText(c *sqlstmt.Column, v any) (string, bool) {
+	if b, ok := sqlstmt.BytesValue(v); ok {
+		v = string(b)
+	}
+	s, ok := v.(string)
+	if !ok {
+		// Numbers, as the router wrote them for the column's type.
+		return fmt.Sprint(v), true
+	}
+	switch c.DataType {
+	case "decimal", "numeric":
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return "", false
+		}
+		return r.RatString(), true
+	case "char", "varchar", "tinytext", "text", "mediumtext", "longtext", "enum":
+		// Trailing spaces are ignored by PAD SPACE collations.
+		s = strings.TrimRight(s, " ")
+		if c.Collation == "binary" || strings.HasSuffix(c.Collation, "_bin") {
+			return s, true
+		}
+		if !foldsCase(c.Collation) || !printableASCII(s) {
+			return "", false
+		}
+		return strings.ToLower(s), true
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		// BINARY(n) pads with zero bytes.
+		return strings.TrimRight(s, "\x00"), true
+	}
+	return "", false
+}
+
+// foldsCase reports whether collation compares printable ASCII text ignoring
+// case and nothing else. Language-specific collations may not: some treat
+// two letters as one.
+func foldsCase(collation string) bool {
+	_, rest, _ := strings.Cut(collation, "_")
+	switch rest {
+	case "general_ci", "unicode_ci", "unicode_520_ci", "0900_ai_ci", "0900_as_ci":
+		return true
+	}
+	return collation == "latin1_swedish_ci"
+}
+
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
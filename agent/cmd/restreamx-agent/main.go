@@ -3,35 +3,72 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
+	"net"
 	"net/http"
-	"os/exec"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"restreamx/pkg/api"
+	"restreamx/pkg/mysql"
+	"restreamx/pkg/sqlstmt"
 )
 
-type payload struct {
-	Op    string                 `json:"op"`
-	Table string                 `json:"table"`
-	ID    int                    `json:"id"`
-	Data  map[string]interface{} `json:"data"`
-}
+const ackInterval = 10 * time.Second
+
+// leaseWatchWait is how long each lease watch waits for a change.
+const leaseWatchWait = 30 * time.Second
 
 type agent struct {
-	ledger    *api.Client
-	host      string
-	port      int
-	user      string
-	pass      string
-	db        string
-	applied   uint64
-	lastEpoch uint64
+	ledger  *api.Client
+	id      string
+	nodeID  string
+	db      *mysql.Pool
+	dbName  string
+	ranges  []string
+	tables  sqlstmt.Tables
+	applied uint64
+	// saved is the stream position last saved as the StreamRange checkpoint;
+	// the ledger is acknowledged only that far, so a restart never needs a
+	// segment it has compacted.
+	saved   uint64
+	rejects uint64
+	// poison is the -poison policy, applied to a segment that has failed
+	// poisonAfter times for a reason of its own.
+	poison      string
+	poisonAfter int
+	retries     uint64
+	gaps        uint64
+	quarantined uint64
+	stuck       stuckState
+	sched       *scheduler
+	// batchSize and batchWait bound how many segments are applied in one
+	// transaction and how long dispatch waits to gather them.
+	batchSize      int
+	batchWait      time.Duration
+	batches        uint64
+	batchFallbacks uint64
+	// schemas are the tables read to tell the rows segments write apart.
+	schemaMu sync.Mutex
+	schemas  map[string]cachedTable
+
+	mu sync.Mutex
+	// checkpoints is the commit index through which each range is applied
+	// and epochs the highest epoch applied in it, as in rlr_meta.checkpoints
+	// once dirty has been saved.
+	checkpoints map[string]uint64
+	epochs      map[string]uint64
+	dirty       map[string]bool
+	saveMu      sync.Mutex
 }
 
 func main() {
@@ -42,87 +79,426 @@ func main() {
 	var mysqlPass = flag.String("mysql-pass", "apply", "mysql pass")
 	var mysqlDB = flag.String("mysql-db", "demo", "mysql db")
 	var metrics = flag.String("metrics", ":9090", "metrics")
+	var ranges = flag.String("ranges", "", "comma range ids to apply (default: restreamx.lease_range_ids, or all)")
+	var agentID = flag.String("agent-id", "", "id acknowledged to the ledger (default: hostname)")
+	var nodeID = flag.String("node-id", "", "this node's owner id in leases (default: restreamx.node_id)")
+	var tables = flag.String("tables", "accounts,orders", "tables segments may write, as t1,t2 or range=t1,t2;range=t3")
+	var poison = flag.String("poison", poisonHalt, "what to do with a segment MySQL keeps rejecting: halt, or quarantine it in rlr_meta.dead_letters and go on")
+	var poisonAfter = flag.Int("poison-attempts", 5, "attempts before -poison applies to a segment MySQL rejects")
+	var workers = flag.Int("workers", 4, "segments applied at once, when they write different rows")
+	var batchSize = flag.Int("batch-size", 100, "most consecutive segments applied in one transaction")
+	var batchWait = flag.Duration("batch-wait", 5*time.Millisecond, "how long to wait for more segments to fill a transaction")
 	flag.Parse()
 
-	ag := &agent{ledger: api.NewClient(*ledgerAddr, 5*time.Second), host: *mysqlHost, port: *mysqlPort, user: *mysqlUser, pass: *mysqlPass, db: *mysqlDB}
+	if *poison != poisonHalt && *poison != poisonQuarantine {
+		log.Fatalf("-poison must be %s or %s", poisonHalt, poisonQuarantine)
+	}
+
+	allowed, err := sqlstmt.ParseTables(*tables)
+	if err != nil {
+		log.Fatalf("-tables: %v", err)
+	}
+	if *agentID == "" {
+		*agentID, _ = os.Hostname()
+	}
+	db := mysql.NewPool(mysql.Config{Addr: net.JoinHostPort(*mysqlHost, strconv.Itoa(*mysqlPort)), User: *mysqlUser, Password: *mysqlPass, Database: *mysqlDB}, 0, 0)
+	ag := &agent{ledger: api.NewClient(*ledgerAddr, 5*time.Second), id: *agentID, nodeID: *nodeID, db: db, dbName: *mysqlDB, tables: allowed, poison: *poison, poisonAfter: max(*poisonAfter, 1), sched: newScheduler(max(*workers, 1)), batchSize: max(*batchSize, 1), batchWait: *batchWait, dirty: map[string]bool{}, schemas: map[string]cachedTable{}}
+	ag.ranges = ag.resolveRanges(*ranges)
+	log.Printf("subscribing to ranges %v", ag.ranges)
+	for i := 0; i < ag.sched.workers; i++ {
+		go ag.worker()
+	}
 	go ag.subscribeLoop()
+	go ag.ackLoop()
+	go ag.leaseLoop()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/metrics", ag.handleMetrics)
+	mux.HandleFunc("/status", ag.handleStatus)
 	log.Printf("metrics on %s", *metrics)
 	if err := http.ListenAndServe(*metrics, mux); err != nil {
 		log.Fatalf("metrics: %v", err)
 	}
 }
 
+// resolveRanges picks the ranges to subscribe to: the -ranges flag, else the
+// node's restreamx.lease_range_ids, else every range (nil).
+func (a *agent) resolveRanges(flagValue string) []string {
+	raw := flagValue
+	if raw == "" {
+		res, err := a.db.Query(context.Background(), "SELECT @@GLOBAL.restreamx.lease_range_ids")
+		if err != nil {
+			log.Printf("read restreamx.lease_range_ids: %v", err)
+		} else if len(res.Rows) == 1 {
+			raw, _ = res.Rows[0][0].(string)
+		}
+	}
+	var ranges []string
+	for _, r := range strings.Split(raw, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// resume loads the checkpoints, retrying until MySQL answers, and returns
+// the commit index to stream from: after the saved stream position. Segments
+// of a range through its own checkpoint are then skipped, and one that does
+// not follow the range's checkpoint is fetched again from there.
+func (a *agent) resume() uint64 {
+	var cps, epochs map[string]uint64
+	for {
+		var err error
+		cps, epochs, err = a.loadCheckpoints()
+		if err == nil {
+			break
+		}
+		log.Printf("load checkpoints: %v", err)
+		time.Sleep(time.Second)
+	}
+	through := resumeIndex(cps, a.ranges)
+	delete(cps, sqlstmt.StreamRange)
+	delete(epochs, sqlstmt.StreamRange)
+	a.mu.Lock()
+	a.checkpoints, a.epochs = cps, epochs
+	a.mu.Unlock()
+	atomic.StoreUint64(&a.applied, through)
+	atomic.StoreUint64(&a.saved, through)
+	if through > 0 {
+		log.Printf("resuming after commit index %d", through)
+	}
+	return through + 1
+}
+
+// resumeIndex returns the commit index through which every segment of ranges
+// is applied, given the checkpoints: the StreamRange one or, if none has been
+// saved yet, the lowest of the ranges' own, or 0 if one of them has none.
+// Without ranges every checkpoint counts.
+func resumeIndex(cps map[string]uint64, ranges []string) uint64 {
+	if ci, ok := cps[sqlstmt.StreamRange]; ok {
+		return ci
+	}
+	if len(ranges) == 0 {
+		for r := range cps {
+			ranges = append(ranges, r)
+		}
+	}
+	var through uint64
+	for i, r := range ranges {
+		if ci := cps[r]; i == 0 || ci < through {
+			through = ci
+		}
+	}
+	return through
+}
+
+// loadCheckpoints returns each range's checkpoint and epoch, and the stream
+// position under StreamRange.
+func (a *agent) loadCheckpoints() (map[string]uint64, map[string]uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := a.db.Query(ctx, "SELECT range_id, commit_index, epoch FROM "+sqlstmt.CheckpointTable)
+	if err != nil {
+		return nil, nil, err
+	}
+	cps := make(map[string]uint64, len(res.Rows))
+	epochs := make(map[string]uint64, len(res.Rows))
+	for _, row := range res.Rows {
+		r, _ := row[0].(string)
+		ci, _ := row[1].(int64)
+		e, _ := row[2].(int64)
+		cps[r], epochs[r] = uint64(ci), uint64(e)
+	}
+	return cps, epochs, nil
+}
+
+// subscribeLoop streams the agent's segments and dispatches them in commit
+// order, in batches of those that arrive within -batch-wait of each other.
 func (a *agent) subscribeLoop() {
-	var from uint64 = 1
+	from := a.resume()
+	// seen and seenEpochs track the segments dispatched, ahead of the
+	// checkpoints.
+	a.mu.Lock()
+	seen, seenEpochs := maps.Clone(a.checkpoints), maps.Clone(a.epochs)
+	a.mu.Unlock()
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		segs, err := a.ledger.Subscribe(ctx, from)
-		cancel()
+		stream, err := a.ledger.Stream(context.Background(), &api.SubscribeRequest{FromCommitIndex: from, RangeIds: a.ranges})
+		if errors.Is(err, api.ErrCompacted) {
+			log.Printf("subscribe from %d: %v; this replica must be re-seeded from a snapshot", from, err)
+			time.Sleep(30 * time.Second)
+			continue
+		}
 		if err != nil {
 			log.Printf("subscribe: %v", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		for _, seg := range segs {
-			if seg.Epoch < atomic.LoadUint64(&a.lastEpoch) {
+		stop := make(chan struct{})
+		segs, errc := readStream(stream, stop, a.batchSize)
+		var batch []*api.Segment
+		var size int
+		var linger <-chan time.Time
+		flush := func() {
+			if len(batch) > 0 {
+				a.dispatch(batch)
+			}
+			batch, size, linger = nil, 0, nil
+		}
+	recv:
+		for {
+			var seg *api.Segment
+			select {
+			case s, ok := <-segs:
+				if !ok {
+					log.Printf("subscribe: %v", <-errc)
+					break recv
+				}
+				seg = s
+			case <-linger:
+				flush()
 				continue
 			}
-			if err := a.applySegment(seg); err != nil {
-				log.Printf("apply error: %v", err)
+			if seg.CommitIndex <= seen[seg.RangeId] {
+				from = seg.CommitIndex + 1
 				continue
 			}
-			atomic.StoreUint64(&a.applied, seg.CommitIndex)
-			atomic.StoreUint64(&a.lastEpoch, seg.Epoch)
+			if last := seen[seg.RangeId]; seg.PrevCommitIndex > last {
+				// A segment of the range was missed; fetch again from it.
+				atomic.AddUint64(&a.gaps, 1)
+				log.Printf("gap in %s: segment %d follows %d, but %d is the last received", seg.RangeId, seg.CommitIndex, seg.PrevCommitIndex, last)
+				from = last + 1
+				break recv
+			}
+			seen[seg.RangeId] = seg.CommitIndex
 			from = seg.CommitIndex + 1
+			if seg.Epoch < seenEpochs[seg.RangeId] {
+				// Written under a lease the range has since moved on from.
+				flush()
+				a.pass(seg)
+				continue
+			}
+			seenEpochs[seg.RangeId] = seg.Epoch
+			batch = append(batch, seg)
+			size += len(seg.PayloadBytes)
+			if len(batch) >= a.batchSize || size >= maxBatchBytes {
+				flush()
+			} else if linger == nil {
+				linger = time.After(a.batchWait)
+			}
 		}
-		time.Sleep(500 * time.Millisecond)
+		flush()
+		close(stop)
+		_ = stream.Close()
+		time.Sleep(1 * time.Second)
 	}
 }
 
+// ackLoop reports the applied index to the ledger, which registers this agent
+// and keeps every segment it has not yet applied.
+func (a *agent) ackLoop() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := a.ledger.AckAgent(ctx, &api.AgentAckRequest{AgentId: a.id, AppliedIndex: atomic.LoadUint64(&a.saved)})
+		cancel()
+		if err != nil {
+			log.Printf("ack: %v", err)
+		}
+		time.Sleep(ackInterval)
+	}
+}
+
+// leaseLoop watches the leases of the agent's ranges and publishes them to
+// the plugin as soon as a range fails over. restreamx.lease_state lists each
+// range as range_id=epoch, followed by /owner while its lease is live,
+// separated by semicolons. When the agent applies a single range,
+// restreamx.lease_owner and restreamx.lease_epoch say whether this node owns
+// it and at which epoch; with several they stay OFF and 0, since one flag and
+// epoch cannot describe them. Each watch that times out republishes, which
+// drops the owners of leases that have lapsed.
+func (a *agent) leaseLoop() {
+	leases := map[string]*api.Lease{}
+	var rev uint64
+	var owner bool
+	var epoch uint64
+	var state string
+	published := false
+	for {
+		changed, err := a.ledger.WatchLease(context.Background(), &api.WatchLeaseRequest{RangeIds: a.ranges, AfterRevision: rev, WaitMs: leaseWatchWait.Milliseconds()})
+		if err != nil {
+			log.Printf("lease watch: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, lease := range changed {
+			rev = max(rev, lease.Revision)
+			leases[lease.RangeId] = lease
+		}
+		node, err := a.node()
+		if err != nil {
+			log.Printf("lease watch: %v", err)
+			continue
+		}
+		now := time.Now().UnixMilli()
+		ids := make([]string, 0, len(leases))
+		for id := range leases {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		entries := make([]string, 0, len(ids))
+		for _, id := range ids {
+			lease := leases[id]
+			entry := fmt.Sprintf("%s=%d", id, lease.Epoch)
+			if !lease.Expired(now) {
+				entry += "/" + lease.OwnerId
+			}
+			entries = append(entries, entry)
+		}
+		o, e, st := false, uint64(0), strings.Join(entries, ";")
+		if len(a.ranges) == 1 {
+			if lease := leases[a.ranges[0]]; lease != nil {
+				o, e = lease.OwnerId == node && !lease.Expired(now), lease.Epoch
+			}
+		}
+		if published && o == owner && e == epoch && st == state {
+			continue
+		}
+		if err := a.publishLease(o, e, st); err != nil {
+			log.Printf("publish lease: %v", err)
+			continue
+		}
+		owner, epoch, state, published = o, e, st, true
+	}
+}
+
+// node returns this node's owner id: -node-id, else restreamx.node_id, which
+// the router sets.
+func (a *agent) node() (string, error) {
+	if a.nodeID != "" {
+		return a.nodeID, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := a.db.Query(ctx, "SELECT @@GLOBAL.restreamx.node_id")
+	if err != nil {
+		return "", fmt.Errorf("read restreamx.node_id: %w", err)
+	}
+	if len(res.Rows) != 1 {
+		return "", fmt.Errorf("read restreamx.node_id: no row")
+	}
+	node, _ := res.Rows[0][0].(string)
+	return node, nil
+}
+
+// publishLease sets the plugin's lease variables through
+// rlr_meta.publish_lease, which runs as a definer allowed to set them, so the
+// apply user needs no right to set other system variables.
+func (a *agent) publishLease(owner bool, epoch uint64, state string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.db.Exec(ctx, "CALL rlr_meta.publish_lease(?, ?, ?)", owner, epoch, state)
+	return err
+}
+
+// applySegment applies every operation in seg and records seg in
+// rlr_meta.applied_segments, in one transaction, unless it is recorded there
+// already.
 func (a *agent) applySegment(seg *api.Segment) error {
-	var p payload
-	if err := json.Unmarshal(seg.PayloadBytes, &p); err != nil {
+	stmts, err := a.segmentStmts(seg)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
 		return err
 	}
-	stmt := "START TRANSACTION;"
-	switch p.Op {
-	case "insert":
-		stmt += fmt.Sprintf("INSERT INTO %s (id, balance, updated_at) VALUES (%d, %v, NOW()) ON DUPLICATE KEY UPDATE balance=VALUES(balance), updated_at=VALUES(updated_at);", p.Table, p.ID, p.Data["balance"])
-	case "update":
-		stmt += fmt.Sprintf("UPDATE %s SET balance=%v, updated_at=NOW() WHERE id=%d;", p.Table, p.Data["balance"], p.ID)
-	case "delete":
-		stmt += fmt.Sprintf("DELETE FROM %s WHERE id=%d;", p.Table, p.ID)
-	default:
+	defer tx.Rollback(ctx)
+	// On the owner the router writes the applied_segments row before it
+	// appends the segment and commits it with the write, so this waits for
+	// that commit and finds the row.
+	done, err := tx.Query(ctx, "SELECT 1 FROM "+sqlstmt.AppliedTable+" WHERE range_id = ? AND epoch = ? AND txn_id = ? FOR UPDATE", seg.RangeId, seg.Epoch, seg.TxnId)
+	if err != nil {
+		return err
+	}
+	if len(done.Rows) > 0 {
 		return nil
 	}
-	stmt += fmt.Sprintf("INSERT INTO rlr_meta.applied_segments (range_id, epoch, txn_id, commit_index, applied_at) VALUES ('%s', %d, '%s', %d, NOW()) ON DUPLICATE KEY UPDATE commit_index=VALUES(commit_index);", seg.RangeId, seg.Epoch, seg.TxnId, seg.CommitIndex)
-	stmt += "COMMIT;"
-	return execMySQL(a.host, a.port, a.user, a.pass, a.db, stmt)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt.SQL, stmt.Args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
-func (a *agent) handleMetrics(w http.ResponseWriter, _ *http.Request) {
-	applied := atomic.LoadUint64(&a.applied)
-	lastEpoch := atomic.LoadUint64(&a.lastEpoch)
-	_, _ = fmt.Fprintf(w, "agent_applied_index %d\n", applied)
-	_, _ = fmt.Fprintf(w, "agent_last_epoch %d\n", lastEpoch)
+// segmentStmts checks seg and returns the statements applying it, ending
+// with its applied_segments row.
+func (a *agent) segmentStmts(seg *api.Segment) ([]sqlstmt.Stmt, error) {
+	if err := seg.VerifyChecksum(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadSegment, err)
+	}
+	ops, err := sqlstmt.DecodePayload(seg.PayloadType, seg.PayloadBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadSegment, err)
+	}
+	stmts := make([]sqlstmt.Stmt, 0, len(ops)+1)
+	for _, op := range ops {
+		if err := a.tables.Check(seg.RangeId, op.Table); err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadSegment, err)
+		}
+		switch op.Op {
+		case "insert", "update", "delete":
+		default:
+			continue
+		}
+		stmt, err := op.Statement(true)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadSegment, err)
+		}
+		stmts = append(stmts, stmt)
+	}
+	return append(stmts, sqlstmt.MarkApplied(seg.RangeId, seg.Epoch, seg.TxnId, seg.CommitIndex)), nil
 }
 
-func execMySQL(host string, port int, user, pass, db, statement string) error {
-	args := []string{"-h", host, "-P", strconv.Itoa(port), "-u", user}
-	if pass != "" {
-		args = append(args, "-p"+pass)
+func (a *agent) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	st := &api.AgentStatus{AgentId: a.id, AppliedIndex: atomic.LoadUint64(&a.applied), Checkpoints: map[string]uint64{}, Epochs: map[string]uint64{}}
+	a.mu.Lock()
+	for r, ci := range a.checkpoints {
+		if r != sqlstmt.StreamRange {
+			st.Checkpoints[r] = ci
+		}
 	}
-	if db != "" {
-		args = append(args, db)
+	for r, e := range a.epochs {
+		st.Epochs[r] = e
+		st.LastEpoch = max(st.LastEpoch, e)
 	}
-	args = append(args, "-e", statement)
-	cmd := exec.Command("mysql", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mysql exec: %s", strings.TrimSpace(string(out)))
+	a.mu.Unlock()
+	st.StuckCommitIndex, st.StuckSeconds, st.LastError = a.stuck.get()
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+func (a *agent) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	applied := atomic.LoadUint64(&a.applied)
+	_, _ = fmt.Fprintf(w, "agent_applied_index %d\n", applied)
+	a.mu.Lock()
+	ranges := make([]string, 0, len(a.epochs))
+	for r := range a.epochs {
+		ranges = append(ranges, r)
+	}
+	sort.Strings(ranges)
+	for _, r := range ranges {
+		_, _ = fmt.Fprintf(w, "agent_last_epoch{range_id=%q} %d\n", r, a.epochs[r])
 	}
-	return nil
+	a.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "agent_checksum_rejects_total %d\n", atomic.LoadUint64(&a.rejects))
+	_, _ = fmt.Fprintf(w, "agent_apply_retries_total %d\n", atomic.LoadUint64(&a.retries))
+	_, _ = fmt.Fprintf(w, "agent_gaps_total %d\n", atomic.LoadUint64(&a.gaps))
+	_, _ = fmt.Fprintf(w, "agent_quarantined_total %d\n", atomic.LoadUint64(&a.quarantined))
+	_, _ = fmt.Fprintf(w, "agent_apply_inflight %d\n", a.sched.inflight())
+	_, _ = fmt.Fprintf(w, "agent_batches_total %d\n", atomic.LoadUint64(&a.batches))
+	_, _ = fmt.Fprintf(w, "agent_batch_fallbacks_total %d\n", atomic.LoadUint64(&a.batchFallbacks))
+	index, secs, _ := a.stuck.get()
+	_, _ = fmt.Fprintf(w, "agent_stuck_commit_index %d\n", index)
+	_, _ = fmt.Fprintf(w, "agent_stuck_seconds %.0f\n", secs)
 }
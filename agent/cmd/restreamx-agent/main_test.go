@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"restreamx/pkg/api"
+	"restreamx/pkg/sqlstmt"
+)
+
+func TestResumeAfterCompaction(t *testing.T) {
+	// The agent has applied through 140, the last 40 segments all in "busy";
+	// "idle" last had a segment at 3, "new" none, and the ledger compacted
+	// everything the agent acknowledged.
+	const compacted = 140
+	cps := map[string]uint64{sqlstmt.StreamRange: 140, "busy": 140, "idle": 3}
+	for _, ranges := range [][]string{{"busy", "idle"}, {"busy", "idle", "new"}, nil} {
+		if got := resumeIndex(cps, ranges); got < compacted {
+			t.Errorf("ranges %v: resume after %d, below the compacted index %d", ranges, got, compacted)
+		}
+	}
+}
+
+func TestResumeWithoutStreamPosition(t *testing.T) {
+	cps := map[string]uint64{"a": 10, "b": 7, "other": 2}
+	for _, tc := range []struct {
+		ranges []string
+		want   uint64
+	}{
+		{[]string{"a", "b"}, 7},
+		{[]string{"a"}, 10},
+		{[]string{"a", "new"}, 0},
+		{nil, 2},
+	} {
+		if got := resumeIndex(cps, tc.ranges); got != tc.want {
+			t.Errorf("ranges %v: resume after %d, want %d", tc.ranges, got, tc.want)
+		}
+	}
+}
+
+func TestChecksumMismatchIsCounted(t *testing.T) {
+	seg := &api.Segment{RangeId: "r", Epoch: 1, TxnId: "t", PayloadType: sqlstmt.PayloadJSON, PayloadBytes: []byte(`{"op":"insert","table":"a","key":{"id":1}}`)}
+	seg.Seal()
+	seg.PayloadBytes[0] = ' '
+	_, err := (&agent{}).segmentStmts(seg)
+	if !errors.Is(err, errBadSegment) || !errors.Is(err, api.ErrChecksumMismatch) {
+		t.Fatalf("corrupt segment: %v", err)
+	}
+}
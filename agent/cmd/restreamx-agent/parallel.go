@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"restreamx/pkg/api"
+	"restreamx/pkg/sqlstmt"
+)
+
+// maxPending bounds how far dispatch runs ahead of the oldest segment not
+// yet applied.
+const maxPending = 1024
+
+// entry is a batch of consecutive segments handed to the workers.
+type entry struct {
+	segs []*api.Segment
+	// keys are the rows the segments write; a barrier, some of whose rows
+	// cannot be told, runs alone.
+	keys    []string
+	barrier bool
+	done    bool
+	// saved is set once the checkpoints through the batch were written with
+	// it.
+	saved bool
+}
+
+// scheduler runs segments on the workers, any number at once as long as no
+// two write the same row, and keeps the dispatched segments in commit order
+// so the checkpoints only pass segments with nothing unapplied before them.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	workers int
+	active  int
+	busy    map[string]bool
+	barrier bool
+	queue   []*entry
+	work    chan *entry
+}
+
+func newScheduler(workers int) *scheduler {
+	s := &scheduler{workers: workers, busy: map[string]bool{}, work: make(chan *entry, workers)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ready reports whether e can start alongside the segments in flight.
+func (s *scheduler) ready(e *entry) bool {
+	if s.active >= s.workers || len(s.queue) >= maxPending {
+		return false
+	}
+	if e.barrier {
+		return s.active == 0
+	}
+	if s.barrier {
+		return false
+	}
+	for _, k := range e.keys {
+		if s.busy[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// first reports whether seg is in the oldest batch not yet applied. Its
+// segments are applied in order, so none before seg is left.
+func (s *scheduler) first(seg *api.Segment) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue) > 0 && slices.Contains(s.queue[0].segs, seg)
+}
+
+func (s *scheduler) inflight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// dispatch hands segs to a worker once no segment in flight writes a row
+// they write, waiting for one to finish if need be.
+func (a *agent) dispatch(segs []*api.Segment) {
+	e := &entry{segs: segs}
+	for _, seg := range segs {
+		keys, barrier := a.segmentKeys(seg)
+		e.keys = append(e.keys, keys...)
+		e.barrier = e.barrier || barrier
+	}
+	s := a.sched
+	s.mu.Lock()
+	for !s.ready(e) {
+		s.cond.Wait()
+	}
+	s.active++
+	s.barrier = e.barrier
+	for _, k := range e.keys {
+		s.busy[k] = true
+	}
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	s.work <- e
+}
+
+// pass moves the checkpoints past seg, in its turn, without applying it.
+func (a *agent) pass(seg *api.Segment) {
+	s := a.sched
+	s.mu.Lock()
+	for len(s.queue) >= maxPending {
+		s.cond.Wait()
+	}
+	s.queue = append(s.queue, &entry{segs: []*api.Segment{seg}, done: true})
+	moved := a.advance()
+	s.mu.Unlock()
+	if moved {
+		a.saveCheckpoints()
+	}
+}
+
+func (a *agent) worker() {
+	s := a.sched
+	for e := range s.work {
+		if err := a.applyBatch(e); err != nil {
+			if len(e.segs) > 1 {
+				atomic.AddUint64(&a.batchFallbacks, 1)
+				log.Printf("apply %d segments from %d at once: %v; applying them one by one", len(e.segs), e.segs[0].CommitIndex, err)
+			}
+			for _, seg := range e.segs {
+				a.process(seg)
+			}
+		}
+		atomic.AddUint64(&a.batches, 1)
+		s.mu.Lock()
+		s.active--
+		if e.barrier {
+			s.barrier = false
+		}
+		for _, k := range e.keys {
+			delete(s.busy, k)
+		}
+		e.done = true
+		moved := a.advance()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if moved {
+			a.saveCheckpoints()
+		}
+	}
+}
+
+// advance moves the checkpoints over the applied segments at the head of the
+// queue and reports whether any moved. The caller holds sched.mu.
+func (a *agent) advance() bool {
+	s := a.sched
+	n := 0
+	a.mu.Lock()
+	for ; n < len(s.queue) && s.queue[n].done; n++ {
+		e := s.queue[n]
+		for _, seg := range e.segs {
+			a.checkpoints[seg.RangeId] = seg.CommitIndex
+			a.epochs[seg.RangeId] = max(a.epochs[seg.RangeId], seg.Epoch)
+			if !e.saved {
+				a.dirty[seg.RangeId] = true
+			}
+			atomic.StoreUint64(&a.applied, seg.CommitIndex)
+		}
+	}
+	a.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+	clear(s.queue[:n])
+	s.queue = s.queue[n:]
+	s.cond.Broadcast()
+	return true
+}
+
+// saveCheckpoints writes the checkpoints that have moved to
+// rlr_meta.checkpoints. If that fails they are written with the next ones;
+// until then a restart applies some segments again, which their
+// applied_segments rows turn into no-ops.
+func (a *agent) saveCheckpoints() {
+	a.saveMu.Lock()
+	defer a.saveMu.Unlock()
+	a.mu.Lock()
+	ranges := make([]string, 0, len(a.dirty))
+	stmts := make([]sqlstmt.Stmt, 0, len(a.dirty)+1)
+	for r := range a.dirty {
+		ranges = append(ranges, r)
+		stmts = append(stmts, sqlstmt.Checkpoint(r, a.checkpoints[r], a.epochs[r]))
+	}
+	clear(a.dirty)
+	// advance moves applied under mu, so it matches the checkpoints.
+	applied := atomic.LoadUint64(&a.applied)
+	a.mu.Unlock()
+	if len(stmts) == 0 {
+		return
+	}
+	stmts = append(stmts, sqlstmt.Checkpoint(sqlstmt.StreamRange, applied, 0))
+	if err := a.execTx(stmts); err == nil {
+		atomic.StoreUint64(&a.saved, applied)
+	} else {
+		log.Printf("save checkpoints: %v", err)
+		a.mu.Lock()
+		for _, r := range ranges {
+			a.dirty[r] = true
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *agent) execTx(stmts []sqlstmt.Stmt) error {
+	ctx := context.Background()
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt.SQL, stmt.Args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -2,12 +2,12 @@ CREATE DATABASE IF NOT EXISTS demo;
 CREATE TABLE IF NOT EXISTS demo.accounts (
   id INT PRIMARY KEY,
   balance INT NOT NULL,
-  updated_at TIMESTAMP NOT NULL
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 CREATE TABLE IF NOT EXISTS demo.orders (
   id INT PRIMARY KEY,
   balance INT NOT NULL,
-  updated_at TIMESTAMP NOT NULL
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 CREATE DATABASE IF NOT EXISTS rlr_meta;
 CREATE TABLE IF NOT EXISTS rlr_meta.applied_segments (
@@ -16,11 +16,35 @@ CREATE TABLE IF NOT EXISTS rlr_meta.applied_segments (
   txn_id VARCHAR(64) NOT NULL,
   commit_index BIGINT NOT NULL,
   applied_at TIMESTAMP NOT NULL,
-  PRIMARY KEY (range_id, epoch, txn_id)
+  PRIMARY KEY (range_id, epoch, txn_id),
+  KEY range_commit (range_id, commit_index)
+);
+CREATE TABLE IF NOT EXISTS rlr_meta.checkpoints (
+  range_id VARCHAR(128) NOT NULL PRIMARY KEY,
+  commit_index BIGINT NOT NULL,
+  epoch BIGINT NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS rlr_meta.dead_letters (
+  range_id VARCHAR(128) NOT NULL,
+  commit_index BIGINT NOT NULL,
+  epoch BIGINT NOT NULL,
+  txn_id VARCHAR(64) NOT NULL,
+  payload_type VARCHAR(32) NOT NULL,
+  payload LONGBLOB NOT NULL,
+  error TEXT NOT NULL,
+  quarantined_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (range_id, commit_index)
 );
 CREATE USER IF NOT EXISTS 'restreamx_router'@'%' IDENTIFIED BY 'router';
 GRANT INSERT,UPDATE,DELETE,SELECT ON demo.* TO 'restreamx_router'@'%';
+GRANT INSERT,UPDATE,SELECT ON rlr_meta.* TO 'restreamx_router'@'%';
 CREATE USER IF NOT EXISTS 'restreamx_apply'@'%' IDENTIFIED BY 'apply';
 GRANT INSERT,UPDATE,DELETE,SELECT ON demo.* TO 'restreamx_apply'@'%';
-GRANT INSERT,UPDATE ON rlr_meta.* TO 'restreamx_apply'@'%';
+GRANT INSERT,UPDATE,SELECT ON rlr_meta.* TO 'restreamx_apply'@'%';
+CREATE USER IF NOT EXISTS 'restreamx_lease'@'localhost' ACCOUNT LOCK;
+GRANT SYSTEM_VARIABLES_ADMIN ON *.* TO 'restreamx_lease'@'localhost';
+CREATE DEFINER = 'restreamx_lease'@'localhost' PROCEDURE IF NOT EXISTS rlr_meta.publish_lease(IN is_owner BOOL, IN epoch BIGINT UNSIGNED, IN state VARCHAR(4096))
+  SQL SECURITY DEFINER
+  SET GLOBAL restreamx.lease_owner = is_owner, GLOBAL restreamx.lease_epoch = epoch, GLOBAL restreamx.lease_state = state;
+GRANT EXECUTE ON PROCEDURE rlr_meta.publish_lease TO 'restreamx_apply'@'%';
 FLUSH PRIVILEGES;
@@ -25,16 +25,16 @@ mysql_count() {
 mysql_checksum() {
   local svc=$1
   local table=$2
-  "${compose[@]}" exec -T "$svc" mysql -uroot -proot -N -e "SELECT IFNULL(BIT_XOR(CRC32(CONCAT(id,':',balance))),0) FROM demo.${table};"
+  "${compose[@]}" exec -T "$svc" mysql -uroot -proot -N -e "SELECT IFNULL(BIT_XOR(CRC32(CONCAT(id,':',balance,':',updated_at))),0) FROM demo.${table};"
 }
 
 write_ops() {
   local start=$1
   local end=$2
   for i in $(seq "$start" "$end"); do
-    payload=$(printf '{"op":"insert","table":"accounts","id":%d,"data":{"balance":%d}}' "$i" "$i")
+    payload=$(printf '{"op":"insert","table":"accounts","key":{"id":%d},"data":{"balance":%d}}' "$i" "$i")
     curl -s -X POST "${router}/write" -d "$payload" >/dev/null
-    payload=$(printf '{"op":"insert","table":"orders","id":%d,"data":{"balance":%d}}' "$i" "$i")
+    payload=$(printf '{"op":"insert","table":"orders","key":{"id":%d},"data":{"balance":%d}}' "$i" "$i")
     curl -s -X POST "${router}/write" -d "$payload" >/dev/null
   done
 }
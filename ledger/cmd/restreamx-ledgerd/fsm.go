@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"restreamx/ledger/internal/raft"
+	"restreamx/ledger/internal/store"
+	"restreamx/pkg/api"
+)
+
+const (
+	opAcquireLease  = "acquire_lease"
+	opRenewLease    = "renew_lease"
+	opAppendSegment = "append_segment"
+	opAckAgent      = "ack_agent"
+	opRemoveAgent   = "remove_agent"
+	opCompact       = "compact"
+)
+
+// command is the payload of a raft log entry. Every ledger mutation goes
+// through the log so that all nodes apply the same changes in the same order.
+// NowMs is the leader's clock at proposal time; lease expiry is judged against
+// it rather than each node's own clock so that apply stays deterministic.
+type command struct {
+	Op      string                   `json:"op"`
+	NowMs   int64                    `json:"now_ms"`
+	Acquire *api.AcquireLeaseRequest `json:"acquire,omitempty"`
+	Renew   *api.RenewLeaseRequest   `json:"renew,omitempty"`
+	Segment *api.Segment             `json:"segment,omitempty"`
+	Ack     *api.AgentAckRequest     `json:"ack,omitempty"`
+	Compact *compactRequest          `json:"compact,omitempty"`
+}
+
+// compactRequest drops segments below Watermark from the store and raft log
+// entries up to RaftThrough, which every node has already stored. The txn_ids
+// of segments appended before TxnCutoffMs stop deduplicating appends.
+type compactRequest struct {
+	Watermark   uint64 `json:"watermark"`
+	RaftThrough uint64 `json:"raft_through"`
+	TxnCutoffMs int64  `json:"txn_cutoff_ms,omitempty"`
+}
+
+type fsm struct {
+	store *store.Store
+	node  *raft.Node
+}
+
+func (f *fsm) apply(index uint64, data []byte) (any, error) {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return nil, err
+	}
+	switch cmd.Op {
+	case opAcquireLease:
+		return f.acquireLease(index, &cmd)
+	case opRenewLease:
+		return f.renewLease(index, &cmd)
+	case opAppendSegment:
+		return f.appendSegment(index, &cmd)
+	case opAckAgent:
+		return nil, f.ackAgent(index, &cmd)
+	case opRemoveAgent:
+		return nil, f.removeAgent(index, &cmd)
+	case opCompact:
+		return nil, f.compact(index, &cmd)
+	}
+	return nil, fmt.Errorf("unknown command %q", cmd.Op)
+}
+
+// acquireLease grants the range to a new owner at the next epoch, unless
+// another unexpired lease holds it and the request did not name that lease's
+// epoch.
+func (f *fsm) acquireLease(index uint64, cmd *command) (any, error) {
+	req := cmd.Acquire
+	if cur, err := f.store.GetLease(req.RangeId); err == nil && !cur.Expired(cmd.NowMs) && cur.Epoch != req.Epoch {
+		return nil, api.ErrLeaseConflict.Errorf("range %s is held by %s at epoch %d", cur.RangeId, cur.OwnerId, cur.Epoch)
+	}
+	lease := &api.Lease{RangeId: req.RangeId, OwnerId: req.OwnerId, Epoch: f.store.Epoch(req.RangeId) + 1, ExpiryMs: cmd.NowMs + req.TtlMs, Revision: index}
+	if err := f.store.PutLease(index, lease); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	return lease, nil
+}
+
+// renewLease extends the current lease. The renewing owner must present the
+// current epoch; once anyone else has acquired the range it cannot renew.
+func (f *fsm) renewLease(index uint64, cmd *command) (any, error) {
+	req := cmd.Renew
+	cur, err := f.store.GetLease(req.RangeId)
+	if err != nil {
+		return nil, api.ErrLeaseNotFound.Errorf("range %s has no lease", req.RangeId)
+	}
+	if cur.Epoch != req.Epoch || cur.OwnerId != req.OwnerId {
+		return nil, api.ErrLeaseConflict.Errorf("range %s is held by %s at epoch %d", cur.RangeId, cur.OwnerId, cur.Epoch)
+	}
+	lease := &api.Lease{RangeId: cur.RangeId, OwnerId: cur.OwnerId, Epoch: cur.Epoch, ExpiryMs: cmd.NowMs + req.TtlMs, Revision: index}
+	if err := f.store.PutLease(index, lease); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	return lease, nil
+}
+
+// appendSegment assigns the next commit index to a segment. A segment whose
+// txn_id was already appended to the range is not stored again; the original
+// commit index is returned so that retries are safe. Otherwise the ledger acts
+// as the fencing authority: the segment's epoch must be that of the range's
+// current, unexpired lease.
+func (f *fsm) appendSegment(index uint64, cmd *command) (any, error) {
+	seg := cmd.Segment
+	if seg.TxnId != "" {
+		if idx, ok := f.store.LookupTxn(seg.RangeId, seg.TxnId); ok {
+			return &api.AppendSegmentResponse{CommitIndex: idx, Duplicate: true}, nil
+		}
+	}
+	cur, err := f.store.GetLease(seg.RangeId)
+	if err != nil {
+		return nil, api.ErrStaleEpoch.Errorf("range %s has no lease", seg.RangeId)
+	}
+	if cur.Expired(cmd.NowMs) {
+		return nil, api.ErrStaleEpoch.Errorf("lease on range %s at epoch %d has expired", seg.RangeId, cur.Epoch)
+	}
+	if seg.Epoch != cur.Epoch {
+		return nil, api.ErrStaleEpoch.Errorf("segment epoch %d is not current epoch %d of range %s", seg.Epoch, cur.Epoch, seg.RangeId)
+	}
+	idx, err := f.store.NextCommitIndex()
+	if err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	seg.CommitIndex = idx
+	seg.PrevCommitIndex = f.store.Head(seg.RangeId)
+	seg.SealCommit()
+	if err := f.store.PutSegment(index, seg, cmd.NowMs); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	return &api.AppendSegmentResponse{CommitIndex: idx}, nil
+}
+
+func (f *fsm) ackAgent(index uint64, cmd *command) error {
+	if err := f.store.PutAgentAck(index, cmd.Ack.AgentId, cmd.Ack.AppliedIndex); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	return nil
+}
+
+func (f *fsm) removeAgent(index uint64, cmd *command) error {
+	if err := f.store.RemoveAgent(index, cmd.Ack.AgentId); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	return nil
+}
+
+// compact snapshots the store and drops compacted segments. The raft log is
+// trimmed only after the store snapshot is durable, so a restart never needs
+// an entry that is gone.
+func (f *fsm) compact(index uint64, cmd *command) error {
+	if err := f.store.Compact(index, cmd.Compact.Watermark, cmd.Compact.TxnCutoffMs); err != nil {
+		log.Fatalf("apply %d: %v", index, err)
+	}
+	if err := f.node.CompactLog(cmd.Compact.RaftThrough); err != nil {
+		log.Printf("raft log compaction through %d: %v", cmd.Compact.RaftThrough, err)
+	}
+	return nil
+}
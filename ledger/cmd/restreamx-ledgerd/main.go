@@ -3,14 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,18 +22,55 @@ import (
 )
 
 type server struct {
-	selfAddr string
-	quorum   *raft.Quorum
-	store    *store.Store
-	mu       sync.Mutex
+	node            *raft.Node
+	store           *store.Store
+	timeout         time.Duration
+	dedupeWindow    time.Duration
+	checksumRejects uint64
 }
 
-func newServer(self string, peers []string, st *store.Store) *server {
-	return &server{
-		selfAddr: self,
-		quorum:   &raft.Quorum{LeaderAddr: self, Peers: peers, Timeout: 2 * time.Second},
-		store:    st,
+func newServer(node *raft.Node, st *store.Store, dedupeWindow time.Duration) *server {
+	return &server{node: node, store: st, timeout: 5 * time.Second, dedupeWindow: dedupeWindow}
+}
+
+// propose replicates cmd through the raft log and returns the state machine's
+// result once it is applied. On failure the error response has been written.
+func (s *server) propose(w http.ResponseWriter, r *http.Request, cmd *command) (any, bool) {
+	cmd.NowMs = time.Now().UnixMilli()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+	res, err := s.node.Propose(ctx, data)
+	var apiErr *api.Error
+	switch {
+	case err == nil:
+		return res, true
+	case errors.Is(err, raft.ErrNotLeader):
+		s.notLeader(w)
+	case errors.As(err, &apiErr):
+		writeError(w, apiErr)
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+	}
+	return nil, false
+}
+
+func (s *server) notLeader(w http.ResponseWriter) {
+	if leader := s.node.Leader(); leader != "" {
+		w.Header().Set(api.LeaderHeader, leader)
 	}
+	writeError(w, api.ErrNotLeader)
+}
+
+func writeError(w http.ResponseWriter, err *api.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	_ = json.NewEncoder(w).Encode(err)
 }
 
 func (s *server) acquireLease(w http.ResponseWriter, r *http.Request) {
@@ -40,22 +79,11 @@ func (s *server) acquireLease(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !s.quorum.IsLeader(s.selfAddr) {
-		w.WriteHeader(http.StatusConflict)
-		_, _ = w.Write([]byte("not leader"))
-		return
-	}
-	lease := &api.Lease{RangeId: req.RangeId, OwnerId: req.OwnerId, Epoch: uint64(time.Now().UnixNano()), ExpiryMs: time.Now().Add(time.Duration(req.TtlMs) * time.Millisecond).UnixMilli()}
-	if err := s.store.PutLease(lease); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	res, ok := s.propose(w, r, &command{Op: opAcquireLease, Acquire: &req})
+	if !ok {
 		return
 	}
-	if err := s.quorum.ReplicateLease(r.Context(), lease); err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte(err.Error()))
-		return
-	}
-	_ = json.NewEncoder(w).Encode(lease)
+	_ = json.NewEncoder(w).Encode(res)
 }
 
 func (s *server) renewLease(w http.ResponseWriter, r *http.Request) {
@@ -64,24 +92,11 @@ func (s *server) renewLease(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !raft.ReplicationHeader(r) && !s.quorum.IsLeader(s.selfAddr) {
-		w.WriteHeader(http.StatusConflict)
-		_, _ = w.Write([]byte("not leader"))
+	res, ok := s.propose(w, r, &command{Op: opRenewLease, Renew: &req})
+	if !ok {
 		return
 	}
-	lease := &api.Lease{RangeId: req.RangeId, OwnerId: req.OwnerId, Epoch: req.Epoch, ExpiryMs: time.Now().Add(time.Duration(req.TtlMs) * time.Millisecond).UnixMilli()}
-	if err := s.store.PutLease(lease); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if !raft.ReplicationHeader(r) {
-		if err := s.quorum.ReplicateLease(r.Context(), lease); err != nil {
-			w.WriteHeader(http.StatusBadGateway)
-			_, _ = w.Write([]byte(err.Error()))
-			return
-		}
-	}
-	_ = json.NewEncoder(w).Encode(lease)
+	_ = json.NewEncoder(w).Encode(res)
 }
 
 func (s *server) getLease(w http.ResponseWriter, r *http.Request) {
@@ -90,57 +105,153 @@ func (s *server) getLease(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !s.node.IsLeader() {
+		s.notLeader(w)
+		return
+	}
 	lease, err := s.store.GetLease(rangeID)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+	if err != nil || lease.Expired(time.Now().UnixMilli()) {
+		writeError(w, api.ErrLeaseNotFound)
 		return
 	}
 	_ = json.NewEncoder(w).Encode(lease)
 }
 
+// watchLease returns the leases changed since after_revision, restricted to
+// the given range_id parameters if there are any, in revision order. With
+// wait_ms set and no change yet, it holds the request open until a lease is
+// acquired or renewed or the wait elapses, then answers with what it has.
+// Expired leases are returned as they are; callers judge expiry_ms.
+func (s *server) watchLease(w http.ResponseWriter, r *http.Request) {
+	after := queryUint(r, "after_revision")
+	ranges := r.URL.Query()["range_id"]
+	wait := time.Duration(queryUint(r, "wait_ms")) * time.Millisecond
+	if wait > maxSubscribeWait {
+		wait = maxSubscribeWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		if !s.node.IsLeader() {
+			s.notLeader(w)
+			return
+		}
+		changed := s.store.LeaseChanged()
+		leases := s.store.LeasesAfter(after, ranges)
+		if len(leases) > 0 || wait == 0 {
+			if leases == nil {
+				leases = []*api.Lease{}
+			}
+			_ = json.NewEncoder(w).Encode(leases)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func (s *server) appendSegment(w http.ResponseWriter, r *http.Request) {
 	var seg api.Segment
 	if err := json.NewDecoder(r.Body).Decode(&seg); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !raft.ReplicationHeader(r) && !s.quorum.IsLeader(s.selfAddr) {
-		w.WriteHeader(http.StatusConflict)
-		_, _ = w.Write([]byte("not leader"))
+	if err := seg.VerifyChecksum(); err != nil {
+		atomic.AddUint64(&s.checksumRejects, 1)
+		writeError(w, err.(*api.Error))
 		return
 	}
-	idx, err := s.store.NextCommitIndex()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	res, ok := s.propose(w, r, &command{Op: opAppendSegment, Segment: &seg})
+	if !ok {
 		return
 	}
-	seg.CommitIndex = idx
-	if err := s.store.PutSegment(&seg); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *server) ackAgent(w http.ResponseWriter, r *http.Request) {
+	var req api.AgentAckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentId == "" {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if !raft.ReplicationHeader(r) {
-		if err := s.quorum.ReplicateSegment(r.Context(), &seg); err != nil {
-			w.WriteHeader(http.StatusBadGateway)
-			_, _ = w.Write([]byte(err.Error()))
+	if _, ok := s.propose(w, r, &command{Op: opAckAgent, Ack: &req}); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) deregisterAgent(w http.ResponseWriter, r *http.Request) {
+	var req api.DeregisterAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.propose(w, r, &command{Op: opRemoveAgent, Ack: &api.AgentAckRequest{AgentId: req.AgentId}}); !ok {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// compactLoop runs on every node but only proposes on the leader. Segments
+// are compacted below the lowest commit index acknowledged by all registered
+// agents, keeping retain more; with no agents registered nothing is compacted.
+func (s *server) compactLoop(interval time.Duration, retain uint64, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
 			return
+		case <-t.C:
+		}
+		if !s.node.IsLeader() {
+			continue
 		}
+		agents := s.store.Agents()
+		if len(agents) == 0 {
+			continue
+		}
+		min := ^uint64(0)
+		for _, applied := range agents {
+			if applied < min {
+				min = applied
+			}
+		}
+		if min+1 <= retain {
+			continue
+		}
+		watermark := min + 1 - retain
+		if watermark <= s.store.CompactedIndex() {
+			continue
+		}
+		if err := s.proposeCompact(watermark); err != nil {
+			log.Printf("compact to %d: %v", watermark, err)
+			continue
+		}
+		log.Printf("compacted segments below commit index %d", watermark)
 	}
-	_ = json.NewEncoder(w).Encode(api.AppendSegmentResponse{CommitIndex: idx})
 }
 
-func (s *server) subscribe(w http.ResponseWriter, r *http.Request) {
-	from := r.URL.Query().Get("from_commit_index")
-	var start uint64
-	if from != "" {
-		_, _ = fmt.Sscanf(from, "%d", &start)
-	}
-	segs, err := s.store.ListSegments(start)
+func (s *server) proposeCompact(watermark uint64) error {
+	now := time.Now()
+	cmd := &command{Op: opCompact, NowMs: now.UnixMilli(), Compact: &compactRequest{
+		Watermark:   watermark,
+		RaftThrough: s.node.MatchedIndex(),
+		TxnCutoffMs: now.Add(-s.dedupeWindow).UnixMilli(),
+	}}
+	data, err := json.Marshal(cmd)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
-	_ = json.NewEncoder(w).Encode(segs)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err = s.node.Propose(ctx, data)
+	return err
 }
 
 func (s *server) status(w http.ResponseWriter, r *http.Request) {
@@ -149,26 +260,40 @@ func (s *server) status(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	_ = json.NewEncoder(w).Encode(api.StatusResponse{Leader: s.quorum.LeaderAddr, Term: 1, CommitIndex: idx, Peers: s.quorum.Peers})
+	_ = json.NewEncoder(w).Encode(api.StatusResponse{Leader: s.node.Leader(), Term: s.node.Term(), CommitIndex: idx, CompactedIndex: s.store.CompactedIndex(), Peers: s.node.Peers()})
 }
 
-func metricsHandler(st *store.Store) http.HandlerFunc {
+func metricsHandler(s *server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		idx, _ := st.GetCommitIndex()
+		idx, _ := s.store.GetCommitIndex()
+		leader := 0
+		if s.node.IsLeader() {
+			leader = 1
+		}
 		_, _ = fmt.Fprintf(w, "ledger_commit_index %d\n", idx)
+		_, _ = fmt.Fprintf(w, "ledger_compacted_index %d\n", s.store.CompactedIndex())
+		_, _ = fmt.Fprintf(w, "ledger_registered_agents %d\n", len(s.store.Agents()))
+		_, _ = fmt.Fprintf(w, "ledger_raft_term %d\n", s.node.Term())
+		_, _ = fmt.Fprintf(w, "ledger_raft_leader %d\n", leader)
+		_, _ = fmt.Fprintf(w, "ledger_checksum_rejects_total %d\n", atomic.LoadUint64(&s.checksumRejects))
 	}
 }
 
 func main() {
 	var (
-		listen  = flag.String("listen", ":7000", "listen address")
-		data    = flag.String("data", "/var/lib/restreamx/ledger.json", "data path")
-		peers   = flag.String("peers", "", "comma peers addresses")
-		metrics = flag.String("metrics", ":7001", "metrics listen")
-		leader  = flag.String("leader", "", "leader address")
+		listen          = flag.String("listen", ":7000", "listen address")
+		data            = flag.String("data", "/var/lib/restreamx/ledger", "data directory")
+		peers           = flag.String("peers", "", "comma peers addresses")
+		metrics         = flag.String("metrics", ":7001", "metrics listen")
+		id              = flag.String("id", "", "this node's address as listed in -peers")
+		electionTimeout = flag.Duration("election-timeout", time.Second, "minimum raft election timeout")
+		heartbeat       = flag.Duration("heartbeat", 100*time.Millisecond, "raft heartbeat interval")
+		compactEvery    = flag.Duration("compact-interval", time.Minute, "how often the leader compacts acknowledged segments")
+		compactRetain   = flag.Uint64("compact-retain", 10000, "segments to keep below the lowest agent acknowledgement")
+		dedupeWindow    = flag.Duration("dedupe-window", time.Hour, "how long a txn_id deduplicates appends, even once its segment is compacted")
 	)
 	flag.Parse()
-	if err := os.MkdirAll("/var/lib/restreamx", 0755); err != nil && !os.IsExist(err) {
+	if err := os.MkdirAll(*data, 0755); err != nil && !os.IsExist(err) {
 		log.Printf("data dir: %v", err)
 	}
 	st, err := store.Open(*data)
@@ -176,31 +301,47 @@ func main() {
 		log.Fatalf("store open: %v", err)
 	}
 	defer st.Close()
-	peerList := []string{}
-	if *peers != "" {
-		peerList = strings.Split(*peers, ",")
-	}
-	self := *leader
+	self := *id
 	if self == "" {
 		self = *listen
 	}
-	srv := newServer(self, peerList, st)
-	if *leader != "" {
-		srv.quorum.LeaderAddr = *leader
-	} else {
-		srv.quorum.LeaderAddr = *listen
+	peerList := []string{self}
+	if *peers != "" {
+		peerList = strings.Split(*peers, ",")
+	}
+	sm := &fsm{store: st}
+	node, err := raft.NewNode(raft.Config{
+		ID:                self,
+		Peers:             peerList,
+		Dir:               filepath.Join(*data, "raft"),
+		ElectionTimeout:   *electionTimeout,
+		HeartbeatInterval: *heartbeat,
+		Applied:           st.AppliedIndex(),
+		Apply:             sm.apply,
+		Snapshot:          st.Snapshot,
+		Restore:           st.Restore,
+	})
+	if err != nil {
+		log.Fatalf("raft open: %v", err)
 	}
+	sm.node = node
+	srv := newServer(node, st, *dedupeWindow)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/lease/acquire", srv.acquireLease)
 	mux.HandleFunc("/lease/renew", srv.renewLease)
 	mux.HandleFunc("/lease/get", srv.getLease)
+	mux.HandleFunc("/lease/watch", srv.watchLease)
 	mux.HandleFunc("/segment/append", srv.appendSegment)
 	mux.HandleFunc("/segment/subscribe", srv.subscribe)
+	mux.HandleFunc("/segment/stream", srv.stream)
+	mux.HandleFunc("/agent/ack", srv.ackAgent)
+	mux.HandleFunc("/agent/deregister", srv.deregisterAgent)
 	mux.HandleFunc("/status", srv.status)
+	node.Register(mux)
 
 	metricsMux := http.NewServeMux()
-	metricsMux.HandleFunc("/metrics", metricsHandler(st))
+	metricsMux.HandleFunc("/metrics", metricsHandler(srv))
 
 	server := &http.Server{Addr: *listen, Handler: mux}
 	metricsServer := &http.Server{Addr: *metrics, Handler: metricsMux}
@@ -217,12 +358,19 @@ func main() {
 			log.Fatalf("listen: %v", err)
 		}
 	}()
+	node.Start()
+	stopCompact := make(chan struct{})
+	go srv.compactLoop(*compactEvery, *compactRetain, stopCompact)
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
+	close(stopCompact)
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_ = server.Shutdown(ctx)
 	_ = metricsServer.Shutdown(ctx)
+	if err := node.Stop(); err != nil {
+		log.Printf("raft stop: %v", err)
+	}
 	fmt.Println("ledger stopped")
 }
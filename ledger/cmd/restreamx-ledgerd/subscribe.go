@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"restreamx/pkg/api"
+)
+
+const (
+	defaultSubscribeLimit = 1000
+	maxSubscribeLimit     = 10000
+	maxSubscribeWait      = 30 * time.Second
+	streamBatch           = 256
+	streamKeepalive       = 10 * time.Second
+)
+
+func queryUint(r *http.Request, name string) uint64 {
+	v, _ := strconv.ParseUint(r.URL.Query().Get(name), 10, 64)
+	return v
+}
+
+// subscribe returns up to limit segments starting at from_commit_index,
+// restricted to the given range_id parameters if there are any. With
+// wait_ms set and nothing to return yet, it holds the request open until a
+// segment is committed or the wait elapses, then answers with what it has.
+func (s *server) subscribe(w http.ResponseWriter, r *http.Request) {
+	from := queryUint(r, "from_commit_index")
+	ranges := r.URL.Query()["range_id"]
+	limit := int(queryUint(r, "limit"))
+	if limit <= 0 {
+		limit = defaultSubscribeLimit
+	}
+	if limit > maxSubscribeLimit {
+		limit = maxSubscribeLimit
+	}
+	wait := time.Duration(queryUint(r, "wait_ms")) * time.Millisecond
+	if wait > maxSubscribeWait {
+		wait = maxSubscribeWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		changed := s.store.Changed()
+		segs, err := s.store.ListSegments(from, ranges, limit)
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) {
+			writeError(w, apiErr)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(segs) > 0 || wait == 0 {
+			_ = json.NewEncoder(w).Encode(segs)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// stream writes segments from from_commit_index onwards, optionally restricted
+// to the given range_id parameters, as newline-delimited JSON and keeps the
+// response open, pushing new segments as they commit. A blank line is sent
+// when idle so clients can detect a dead connection. The stream ends if
+// compaction overtakes it; reconnecting then reports the compacted error.
+func (s *server) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	from := queryUint(r, "from_commit_index")
+	ranges := r.URL.Query()["range_id"]
+	if from < s.store.CompactedIndex() {
+		writeError(w, api.ErrCompacted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		changed := s.store.Changed()
+		segs, err := s.store.ListSegments(from, ranges, streamBatch)
+		if err != nil {
+			return
+		}
+		for _, seg := range segs {
+			if err := enc.Encode(seg); err != nil {
+				return
+			}
+			from = seg.CommitIndex + 1
+		}
+		if len(segs) > 0 {
+			flusher.Flush()
+			if len(segs) == streamBatch {
+				continue
+			}
+		}
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
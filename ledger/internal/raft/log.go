@@ -0,0 +1,277 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"restreamx/ledger/internal/wal"
+)
+
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// raftLog is the persistent replicated log. Only terms and file positions are
+// kept in memory; entry payloads are read back from the WAL on demand. Entries
+// up to offset have been compacted away; snapTerm is the term of entry offset.
+type raftLog struct {
+	wal      *wal.Log
+	offset   uint64
+	snapTerm uint64
+	terms    []uint64
+	pos      []wal.Position
+}
+
+// logFileSize is the size at which the log rolls over to a new file.
+var logFileSize int64 = wal.DefaultMaxFileSize
+
+func openLog(dir string, offset, snapTerm uint64) (*raftLog, error) {
+	w, err := wal.Open(dir, logFileSize)
+	if err != nil {
+		return nil, err
+	}
+	l := &raftLog{wal: w, offset: offset, snapTerm: snapTerm}
+	err = w.Replay(func(pos wal.Position, rec []byte) error {
+		e, err := decodeEntry(rec)
+		if err != nil {
+			return err
+		}
+		if e.Index <= l.offset {
+			return nil
+		}
+		if e.Index != l.lastIndex()+1 {
+			return fmt.Errorf("raft log: entry %d follows %d", e.Index, l.lastIndex())
+		}
+		l.terms = append(l.terms, e.Term)
+		l.pos = append(l.pos, pos)
+		return nil
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func encodeEntry(e *Entry) []byte {
+	buf := make([]byte, 16+len(e.Data))
+	binary.LittleEndian.PutUint64(buf[0:8], e.Index)
+	binary.LittleEndian.PutUint64(buf[8:16], e.Term)
+	copy(buf[16:], e.Data)
+	return buf
+}
+
+func decodeEntry(rec []byte) (Entry, error) {
+	if len(rec) < 16 {
+		return Entry{}, errors.New("raft log: short entry")
+	}
+	e := Entry{Index: binary.LittleEndian.Uint64(rec[0:8]), Term: binary.LittleEndian.Uint64(rec[8:16])}
+	if len(rec) > 16 {
+		e.Data = rec[16:]
+	}
+	return e, nil
+}
+
+func (l *raftLog) lastIndex() uint64 { return l.offset + uint64(len(l.terms)) }
+
+func (l *raftLog) lastTerm() uint64 { return l.term(l.lastIndex()) }
+
+// term returns the term of entry i, or 0 when it is unknown: beyond the end
+// of the log or compacted away.
+func (l *raftLog) term(i uint64) uint64 {
+	if i == l.offset {
+		return l.snapTerm
+	}
+	if i < l.offset || i > l.lastIndex() {
+		return 0
+	}
+	return l.terms[i-l.offset-1]
+}
+
+// append writes entries, which must directly follow the current last index,
+// and syncs them to disk.
+func (l *raftLog) append(entries ...Entry) error {
+	for _, e := range entries {
+		if e.Index != l.lastIndex()+1 {
+			return fmt.Errorf("raft log: append %d after %d", e.Index, l.lastIndex())
+		}
+		pos, err := l.wal.Append(encodeEntry(&e))
+		if err != nil {
+			return err
+		}
+		l.terms = append(l.terms, e.Term)
+		l.pos = append(l.pos, pos)
+	}
+	return l.wal.Sync()
+}
+
+// truncate removes entry i and everything after it.
+func (l *raftLog) truncate(i uint64) error {
+	if i <= l.offset || i > l.lastIndex() {
+		return nil
+	}
+	if err := l.wal.TruncateFrom(l.pos[i-l.offset-1]); err != nil {
+		return err
+	}
+	l.terms = l.terms[:i-l.offset-1]
+	l.pos = l.pos[:i-l.offset-1]
+	return nil
+}
+
+// compact drops entries up to and including through. Their files stay until
+// removeCompacted, which must wait until the new offset is saved: replay
+// skips entries up to the offset, but cannot bridge a gap before it.
+func (l *raftLog) compact(through uint64) {
+	if through <= l.offset || through > l.lastIndex() {
+		return
+	}
+	n := through - l.offset
+	l.snapTerm = l.term(through)
+	l.terms = append([]uint64(nil), l.terms[n:]...)
+	l.pos = append([]wal.Position(nil), l.pos[n:]...)
+	l.offset = through
+}
+
+// removeCompacted deletes the log files that hold only compacted entries.
+func (l *raftLog) removeCompacted() error {
+	if len(l.pos) == 0 {
+		return nil
+	}
+	return l.wal.RemoveBefore(l.pos[0].File)
+}
+
+// reset drops every entry, leaving an empty log that follows entry offset of
+// term snapTerm.
+func (l *raftLog) reset(offset, snapTerm uint64) error {
+	if len(l.pos) > 0 {
+		if err := l.wal.TruncateFrom(l.pos[0]); err != nil {
+			return err
+		}
+	}
+	l.terms, l.pos = nil, nil
+	l.offset, l.snapTerm = offset, snapTerm
+	return l.wal.RemoveBefore(^uint64(0))
+}
+
+func (l *raftLog) entry(i uint64) (Entry, error) {
+	if i <= l.offset || i > l.lastIndex() {
+		return Entry{}, fmt.Errorf("raft log: no entry %d", i)
+	}
+	rec, err := l.wal.ReadAt(l.pos[i-l.offset-1])
+	if err != nil {
+		return Entry{}, err
+	}
+	return decodeEntry(rec)
+}
+
+// slice returns up to max entries starting at from.
+func (l *raftLog) slice(from uint64, max int) ([]Entry, error) {
+	out := []Entry{}
+	for i := from; i <= l.lastIndex() && len(out) < max; i++ {
+		e, err := l.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (l *raftLog) close() error { return l.wal.Close() }
+
+// hardState is the node's durable election state plus the point up to which
+// its log has been compacted.
+type hardState struct {
+	Term      uint64 `json:"term"`
+	VotedFor  string `json:"voted_for"`
+	SnapIndex uint64 `json:"snap_index,omitempty"`
+	SnapTerm  uint64 `json:"snap_term,omitempty"`
+}
+
+func loadHardState(path string) (hardState, error) {
+	var hs hardState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return hs, nil
+	}
+	if err != nil {
+		return hs, err
+	}
+	err = json.Unmarshal(data, &hs)
+	return hs, err
+}
+
+func saveHardState(path string, hs hardState) error { return saveJSON(path, hs) }
+
+// install records a snapshot install in progress: once the state machine
+// holds the snapshot through Index, the log must be reset to follow it.
+type install struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+// finishInstall completes the install recorded at path if the state machine
+// has applied through its index, resetting lg and the hard state to follow
+// it, and otherwise drops it. It is safe to repeat after a crash part way.
+func finishInstall(path, statePath string, applied uint64, lg *raftLog, hs *hardState) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var inst install
+	if err := json.Unmarshal(data, &inst); err != nil {
+		return err
+	}
+	if applied >= inst.Index {
+		if err := lg.reset(inst.Index, inst.Term); err != nil {
+			return err
+		}
+		hs.SnapIndex, hs.SnapTerm = inst.Index, inst.Term
+		if err := saveHardState(statePath, *hs); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// saveJSON durably replaces the file at path with v.
+func saveJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,762 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader = errors.New("not leader")
+	ErrDropped   = errors.New("proposal dropped after leadership change")
+	ErrStopped   = errors.New("raft stopped")
+)
+
+const (
+	maxAppendEntries = 256
+	// snapshotTimeout bounds sending a snapshot, which may be large.
+	snapshotTimeout = 10 * time.Minute
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// ApplyFunc applies a committed entry to the state machine. It is called once
+// per entry, in log order, from a single goroutine; its result is handed back
+// to the proposer on the leader.
+type ApplyFunc func(index uint64, data []byte) (any, error)
+
+type Config struct {
+	ID                string
+	Peers             []string
+	Dir               string
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	RPCTimeout        time.Duration
+	// Applied is the last index the state machine has durably applied; entries
+	// up to it are not replayed on restart.
+	Applied uint64
+	Apply   ApplyFunc
+	// Snapshot returns the state machine's state as of the last applied
+	// entry, for a peer that needs entries already compacted; it is called
+	// between applies. Restore replaces the state machine's state with such a
+	// snapshot taken through index, and must leave either the old state or the
+	// new one if interrupted. Without them a peer that falls behind the
+	// compacted log cannot catch up.
+	Snapshot func() (io.ReadCloser, error)
+	Restore  func(index uint64, r io.Reader) error
+}
+
+type result struct {
+	value any
+	err   error
+}
+
+type waiter struct {
+	term uint64
+	ch   chan result
+}
+
+type Node struct {
+	cfg            Config
+	peers          []string
+	client         *http.Client
+	snapshotClient *http.Client
+	statePath      string
+	installPath    string
+
+	// applyMu is held while the state machine changes, by an apply or a
+	// snapshot install, and while a snapshot is taken.
+	applyMu          sync.Mutex
+	mu               sync.Mutex
+	log              *raftLog
+	role             role
+	term             uint64
+	votedFor         string
+	leader           string
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	electionDeadline time.Time
+	waiters          map[uint64]*waiter
+	installing       bool
+
+	applyCh     chan struct{}
+	replicateCh map[string]chan struct{}
+	stop        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if cfg.RPCTimeout <= 0 {
+		cfg.RPCTimeout = 2 * time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	statePath := filepath.Join(cfg.Dir, "state.json")
+	hs, err := loadHardState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	lg, err := openLog(cfg.Dir, hs.SnapIndex, hs.SnapTerm)
+	if err != nil {
+		return nil, err
+	}
+	installPath := filepath.Join(cfg.Dir, "install.json")
+	if err := finishInstall(installPath, statePath, cfg.Applied, lg, &hs); err != nil {
+		lg.close()
+		return nil, err
+	}
+	// Entries are only compacted once the state machine has applied them.
+	applied := cfg.Applied
+	if applied < lg.offset {
+		applied = lg.offset
+	}
+	if applied > lg.lastIndex() {
+		applied = lg.lastIndex()
+	}
+	n := &Node{
+		cfg:            cfg,
+		client:         &http.Client{Timeout: cfg.RPCTimeout},
+		snapshotClient: &http.Client{Timeout: snapshotTimeout},
+		statePath:      statePath,
+		installPath:    installPath,
+		log:            lg,
+		term:           hs.Term,
+		votedFor:       hs.VotedFor,
+		commitIndex:    applied,
+		lastApplied:    applied,
+		nextIndex:      map[string]uint64{},
+		matchIndex:     map[string]uint64{},
+		waiters:        map[uint64]*waiter{},
+		applyCh:        make(chan struct{}, 1),
+		replicateCh:    map[string]chan struct{}{},
+		stop:           make(chan struct{}),
+	}
+	for _, p := range cfg.Peers {
+		if p != cfg.ID {
+			n.peers = append(n.peers, p)
+			n.replicateCh[p] = make(chan struct{}, 1)
+		}
+	}
+	n.resetElectionDeadline()
+	return n, nil
+}
+
+func (n *Node) Start() {
+	n.wg.Add(2 + len(n.peers))
+	go n.tickLoop()
+	go n.applyLoop()
+	for _, p := range n.peers {
+		go n.replicateLoop(p)
+	}
+}
+
+func (n *Node) Stop() error {
+	close(n.stop)
+	n.wg.Wait()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failWaiters(0, ErrStopped)
+	return n.log.close()
+}
+
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Leader returns the ID of the current leader as known to this node, or ""
+// while an election is in progress.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+func (n *Node) Peers() []string { return n.cfg.Peers }
+
+// Propose appends data to the log and waits until it is committed and applied,
+// returning the state machine's result. Only the leader accepts proposals.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.log.append(e); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	w := &waiter{term: e.Term, ch: make(chan result, 1)}
+	n.waiters[e.Index] = w
+	n.matchIndex[n.cfg.ID] = e.Index
+	n.advanceCommit()
+	n.triggerReplication()
+	n.mu.Unlock()
+
+	select {
+	case r := <-w.ch:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if n.waiters[e.Index] == w {
+			delete(n.waiters, e.Index)
+		}
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.stop:
+		return nil, ErrStopped
+	}
+}
+
+func (n *Node) quorum() int { return (len(n.peers)+1)/2 + 1 }
+
+func (n *Node) resetElectionDeadline() {
+	jitter := time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(n.cfg.ElectionTimeout + jitter)
+}
+
+func (n *Node) persistHardState() error {
+	return saveHardState(n.statePath, hardState{Term: n.term, VotedFor: n.votedFor, SnapIndex: n.log.offset, SnapTerm: n.log.snapTerm})
+}
+
+// MatchedIndex returns, on the leader, the highest log index every node has
+// stored and this node has applied; log entries up to it are no longer needed
+// by anyone. It returns 0 on other nodes.
+func (n *Node) MatchedIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != leader {
+		return 0
+	}
+	min := n.lastApplied
+	for _, p := range n.peers {
+		if n.matchIndex[p] < min {
+			min = n.matchIndex[p]
+		}
+	}
+	return min
+}
+
+// CompactLog discards log entries up to and including through. Entries that
+// are not yet applied are kept.
+func (n *Node) CompactLog(through uint64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if through > n.lastApplied {
+		through = n.lastApplied
+	}
+	if through <= n.log.offset {
+		return nil
+	}
+	n.log.compact(through)
+	if err := n.persistHardState(); err != nil {
+		return err
+	}
+	return n.log.removeCompacted()
+}
+
+func (n *Node) becomeFollower(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.persistHardState(); err != nil {
+			log.Fatalf("raft: persist state: %v", err)
+		}
+	}
+	if n.role != follower {
+		log.Printf("raft: %s stepping down to follower in term %d", n.cfg.ID, n.term)
+	}
+	n.role = follower
+	n.leader = leaderID
+	n.resetElectionDeadline()
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.cfg.ID
+	last := n.log.lastIndex()
+	for _, p := range n.peers {
+		n.nextIndex[p] = last + 1
+		n.matchIndex[p] = 0
+	}
+	log.Printf("raft: %s elected leader in term %d", n.cfg.ID, n.term)
+	// An empty entry from the new term lets entries from earlier terms commit.
+	noop := Entry{Index: last + 1, Term: n.term}
+	if err := n.log.append(noop); err != nil {
+		log.Fatalf("raft: append: %v", err)
+	}
+	n.matchIndex[n.cfg.ID] = noop.Index
+	n.advanceCommit()
+	n.triggerReplication()
+}
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		if n.role != leader && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	if err := n.persistHardState(); err != nil {
+		log.Fatalf("raft: persist state: %v", err)
+	}
+	n.resetElectionDeadline()
+	term := n.term
+	req := &VoteRequest{Term: term, CandidateID: n.cfg.ID, LastLogIndex: n.log.lastIndex(), LastLogTerm: n.log.lastTerm()}
+	log.Printf("raft: %s starting election for term %d", n.cfg.ID, term)
+	if n.quorum() == 1 {
+		n.becomeLeader()
+		return
+	}
+	votes := 1
+	for _, p := range n.peers {
+		go func(peer string) {
+			var resp VoteResponse
+			if err := n.call(peer, votePath, req, &resp); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			select {
+			case <-n.stop:
+				return
+			default:
+			}
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+				return
+			}
+			if n.role != candidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+func (n *Node) triggerReplication() {
+	for _, ch := range n.replicateCh {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) replicateLoop(peer string) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		case <-n.replicateCh[peer]:
+		}
+		for n.sendAppend(peer) {
+		}
+	}
+}
+
+// sendAppend sends one AppendEntries RPC to peer and reports whether the peer
+// still lags behind and should be sent another batch right away.
+func (n *Node) sendAppend(peer string) bool {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return false
+	}
+	term := n.term
+	next := n.nextIndex[peer]
+	prev := next - 1
+	if prev < n.log.offset {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer)
+	}
+	entries, err := n.log.slice(next, maxAppendEntries)
+	if err != nil {
+		n.mu.Unlock()
+		log.Printf("raft: read log for %s: %v", peer, err)
+		return false
+	}
+	req := &AppendRequest{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log.term(prev),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	var resp AppendResponse
+	if err := n.call(peer, appendPath, req, &resp); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+	if !resp.Success {
+		next := resp.LastIndex + 1
+		if next >= n.nextIndex[peer] {
+			next = n.nextIndex[peer] - 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+		return true
+	}
+	match := prev + uint64(len(entries))
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+	}
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// sendSnapshot sends peer the state machine's state in place of entries it
+// needs that have been compacted, and reports whether the peer should be sent
+// entries right away.
+func (n *Node) sendSnapshot(peer string) bool {
+	if n.cfg.Snapshot == nil {
+		log.Printf("raft: %s needs compacted entries and there is no snapshot to send", peer)
+		return false
+	}
+	n.applyMu.Lock()
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		n.applyMu.Unlock()
+		return false
+	}
+	req := &SnapshotRequest{Term: n.term, LeaderID: n.cfg.ID, LastIndex: n.lastApplied, LastTerm: n.log.term(n.lastApplied)}
+	n.mu.Unlock()
+	body, err := n.cfg.Snapshot()
+	n.applyMu.Unlock()
+	if err != nil {
+		log.Printf("raft: snapshot for %s: %v", peer, err)
+		return false
+	}
+	defer body.Close()
+	log.Printf("raft: sending %s a snapshot through entry %d", peer, req.LastIndex)
+	var resp SnapshotResponse
+	if err := n.callSnapshot(peer, req, body, &resp); err != nil {
+		log.Printf("raft: send snapshot to %s: %v", peer, err)
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false
+	}
+	if n.role != leader || n.term != req.Term {
+		return false
+	}
+	if req.LastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = req.LastIndex
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// advanceCommit moves the commit index to the highest entry of the current
+// term that is stored on a majority of nodes.
+func (n *Node) advanceCommit() {
+	for i := n.log.lastIndex(); i > n.commitIndex; i-- {
+		if n.log.term(i) != n.term {
+			break
+		}
+		count := 0
+		if n.matchIndex[n.cfg.ID] >= i {
+			count++
+		}
+		for _, p := range n.peers {
+			if n.matchIndex[p] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = i
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+		for {
+			n.applyMu.Lock()
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				n.applyMu.Unlock()
+				break
+			}
+			e, err := n.log.entry(n.lastApplied + 1)
+			n.mu.Unlock()
+			if err != nil {
+				log.Fatalf("raft: read entry %d: %v", n.lastApplied+1, err)
+			}
+			var r result
+			if len(e.Data) > 0 {
+				r.value, r.err = n.cfg.Apply(e.Index, e.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if w, ok := n.waiters[e.Index]; ok {
+				delete(n.waiters, e.Index)
+				if w.term != e.Term {
+					r = result{err: ErrDropped}
+				}
+				w.ch <- r
+			}
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+		}
+	}
+}
+
+// failWaiters fails every pending proposal at or after index from.
+func (n *Node) failWaiters(from uint64, err error) {
+	for idx, w := range n.waiters {
+		if idx >= from {
+			w.ch <- result{err: err}
+			delete(n.waiters, idx)
+		}
+	}
+}
+
+func (n *Node) handleVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+	}
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.log.lastTerm() ||
+		(req.LastLogTerm == n.log.lastTerm() && req.LastLogIndex >= n.log.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		if err := n.persistHardState(); err != nil {
+			log.Fatalf("raft: persist state: %v", err)
+		}
+		n.resetElectionDeadline()
+		resp.Granted = true
+	}
+	return resp
+}
+
+func (n *Node) handleAppend(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &AppendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.becomeFollower(req.Term, req.LeaderID)
+	resp.Term = n.term
+	if n.installing {
+		// The log is about to be replaced; take nothing into it meanwhile.
+		resp.LastIndex = n.log.lastIndex()
+		return resp
+	}
+	if req.PrevLogIndex < n.log.offset {
+		// Entries up to offset are committed and in a snapshot already.
+		skip := n.log.offset - req.PrevLogIndex
+		if skip > uint64(len(req.Entries)) {
+			skip = uint64(len(req.Entries))
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex, req.PrevLogTerm = n.log.offset, n.log.snapTerm
+	}
+	if req.PrevLogIndex > n.log.lastIndex() {
+		resp.LastIndex = n.log.lastIndex()
+		return resp
+	}
+	if n.log.term(req.PrevLogIndex) != req.PrevLogTerm {
+		resp.LastIndex = req.PrevLogIndex - 1
+		return resp
+	}
+	var fresh []Entry
+	for i, e := range req.Entries {
+		if e.Index > n.log.lastIndex() {
+			fresh = req.Entries[i:]
+			break
+		}
+		if n.log.term(e.Index) != e.Term {
+			if e.Index <= n.commitIndex {
+				log.Fatalf("raft: leader %s conflicts with committed entry %d", req.LeaderID, e.Index)
+			}
+			if err := n.log.truncate(e.Index); err != nil {
+				log.Fatalf("raft: truncate: %v", err)
+			}
+			n.failWaiters(e.Index, ErrDropped)
+			fresh = req.Entries[i:]
+			break
+		}
+	}
+	if len(fresh) > 0 {
+		if err := n.log.append(fresh...); err != nil {
+			log.Printf("raft: append: %v", err)
+			resp.LastIndex = n.log.lastIndex()
+			return resp
+		}
+	}
+	resp.Success = true
+	resp.LastIndex = n.log.lastIndex()
+	if req.LeaderCommit > n.commitIndex {
+		last := req.PrevLogIndex + uint64(len(req.Entries))
+		if req.LeaderCommit < last {
+			last = req.LeaderCommit
+		}
+		if last > n.commitIndex {
+			n.commitIndex = last
+			n.signalApply()
+		}
+	}
+	return resp
+}
+
+// handleSnapshot replaces the state machine and the log with the leader's
+// snapshot through req.LastIndex. Everything the snapshot covers is
+// committed, so the whole log is dropped and the leader sends what follows.
+func (n *Node) handleSnapshot(req *SnapshotRequest, body io.Reader) (*SnapshotResponse, error) {
+	n.mu.Lock()
+	resp := &SnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.becomeFollower(req.Term, req.LeaderID)
+	resp.Term = n.term
+	n.mu.Unlock()
+	if n.cfg.Restore == nil {
+		return nil, errors.New("raft: cannot restore snapshots")
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if req.LastIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.installing = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.installing = false
+		n.mu.Unlock()
+	}()
+
+	inst := install{Index: req.LastIndex, Term: req.LastTerm}
+	if err := saveJSON(n.installPath, inst); err != nil {
+		return nil, err
+	}
+	if err := n.cfg.Restore(req.LastIndex, &keepAlive{n: n, r: body}); err != nil {
+		os.Remove(n.installPath)
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	hs := hardState{Term: n.term, VotedFor: n.votedFor}
+	if err := finishInstall(n.installPath, n.statePath, req.LastIndex, n.log, &hs); err != nil {
+		log.Fatalf("raft: install snapshot: %v", err)
+	}
+	n.commitIndex, n.lastApplied = req.LastIndex, req.LastIndex
+	n.failWaiters(0, ErrDropped)
+	log.Printf("raft: %s installed a snapshot through entry %d from %s", n.cfg.ID, req.LastIndex, req.LeaderID)
+	return resp, nil
+}
+
+// keepAlive holds off elections while a snapshot is being received.
+type keepAlive struct {
+	n *Node
+	r io.Reader
+}
+
+func (k *keepAlive) Read(p []byte) (int, error) {
+	k.n.mu.Lock()
+	k.n.resetElectionDeadline()
+	k.n.mu.Unlock()
+	return k.r.Read(p)
+}
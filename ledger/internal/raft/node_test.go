@@ -0,0 +1,526 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode is a node that is not started, for driving its handlers directly.
+func testNode(t *testing.T, id string, peers ...string) *Node {
+	t.Helper()
+	n, err := NewNode(Config{ID: id, Peers: append([]string{id}, peers...), Dir: t.TempDir(), Apply: func(uint64, []byte) (any, error) { return nil, nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.log.close() })
+	return n
+}
+
+func entries(term uint64, from, to uint64) []Entry {
+	var out []Entry
+	for i := from; i <= to; i++ {
+		out = append(out, Entry{Index: i, Term: term, Data: []byte{byte(i)}})
+	}
+	return out
+}
+
+func terms(n *Node) []uint64 {
+	var out []uint64
+	for i := n.log.offset + 1; i <= n.log.lastIndex(); i++ {
+		out = append(out, n.log.term(i))
+	}
+	return out
+}
+
+func equalTerms(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAppendRejectsMismatchedPrev(t *testing.T) {
+	n := testNode(t, "f", "l")
+	if resp := n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", Entries: entries(1, 1, 3)}); !resp.Success {
+		t.Fatalf("initial append rejected")
+	}
+	// Prev beyond the end: the follower points the leader at its last index.
+	resp := n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", PrevLogIndex: 5, PrevLogTerm: 1, Entries: entries(1, 6, 6)})
+	if resp.Success || resp.LastIndex != 3 {
+		t.Fatalf("append past the end: success %v, last index %d", resp.Success, resp.LastIndex)
+	}
+	// Prev present under another term.
+	resp = n.handleAppend(&AppendRequest{Term: 2, LeaderID: "l", PrevLogIndex: 3, PrevLogTerm: 2, Entries: entries(2, 4, 4)})
+	if resp.Success || resp.LastIndex != 2 {
+		t.Fatalf("append after mismatched term: success %v, last index %d", resp.Success, resp.LastIndex)
+	}
+	if got := terms(n); !equalTerms(got, []uint64{1, 1, 1}) {
+		t.Fatalf("log changed by rejected appends: %v", got)
+	}
+}
+
+func TestAppendTruncatesConflicts(t *testing.T) {
+	n := testNode(t, "f", "l")
+	n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", Entries: entries(1, 1, 5)})
+	// A new leader never committed entries 3-5 of term 1; it replaces them.
+	resp := n.handleAppend(&AppendRequest{Term: 2, LeaderID: "l", PrevLogIndex: 2, PrevLogTerm: 1, Entries: entries(2, 3, 4)})
+	if !resp.Success || resp.LastIndex != 4 {
+		t.Fatalf("conflicting append: success %v, last index %d", resp.Success, resp.LastIndex)
+	}
+	want := []uint64{1, 1, 2, 2}
+	if got := terms(n); !equalTerms(got, want) {
+		t.Fatalf("log terms %v, want %v", got, want)
+	}
+	// Entries the follower already holds are not appended twice.
+	resp = n.handleAppend(&AppendRequest{Term: 2, LeaderID: "l", PrevLogIndex: 0, Entries: entries(1, 1, 2)})
+	if !resp.Success || resp.LastIndex != 4 {
+		t.Fatalf("repeated append: success %v, last index %d", resp.Success, resp.LastIndex)
+	}
+
+	// The truncation is durable.
+	lg, err := openLog(n.cfg.Dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.log.close()
+	n.log = lg
+	if got := terms(n); !equalTerms(got, want) {
+		t.Fatalf("log terms after reopen %v, want %v", got, want)
+	}
+	e, err := lg.entry(4)
+	if err != nil || e.Term != 2 || e.Data[0] != 4 {
+		t.Fatalf("entry 4 after reopen: %+v, %v", e, err)
+	}
+}
+
+func TestCompactedLogReopens(t *testing.T) {
+	defer func(size int64) { logFileSize = size }(logFileSize)
+	logFileSize = 64 // a few entries per file
+	reopen := func(n *Node) {
+		t.Helper()
+		hs, err := loadHardState(n.statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.log.close()
+		if n.log, err = openLog(n.cfg.Dir, hs.SnapIndex, hs.SnapTerm); err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+	}
+
+	n := testNode(t, "f", "l")
+	n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", Entries: entries(1, 1, 20)})
+	n.lastApplied = 20
+	files := func() int {
+		m, _ := filepath.Glob(filepath.Join(n.cfg.Dir, "*.wal"))
+		return len(m)
+	}
+	before := files()
+	if err := n.CompactLog(12); err != nil {
+		t.Fatal(err)
+	}
+	if files() >= before {
+		t.Fatalf("compaction removed no files: %d before, %d after", before, files())
+	}
+	reopen(n)
+	if n.log.offset != 12 || n.log.lastIndex() != 20 {
+		t.Fatalf("after reopen: offset %d, last %d", n.log.offset, n.log.lastIndex())
+	}
+	if e, err := n.log.entry(13); err != nil || e.Data[0] != 13 {
+		t.Fatalf("entry 13 after reopen: %+v, %v", e, err)
+	}
+
+	// A crash after the offset is saved but before the files go leaves
+	// entries that replay skips.
+	n.log.compact(16)
+	if err := n.persistHardState(); err != nil {
+		t.Fatal(err)
+	}
+	reopen(n)
+	if n.log.offset != 16 || n.log.lastIndex() != 20 || n.log.term(16) != 1 {
+		t.Fatalf("after interrupted compaction: offset %d, last %d", n.log.offset, n.log.lastIndex())
+	}
+}
+
+func TestAppendCommitsUpToLastNewEntry(t *testing.T) {
+	n := testNode(t, "f", "l")
+	n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", Entries: entries(1, 1, 3), LeaderCommit: 10})
+	if n.commitIndex != 3 {
+		t.Fatalf("commit index %d, want 3", n.commitIndex)
+	}
+}
+
+func TestCommitOnlyCurrentTerm(t *testing.T) {
+	n := testNode(t, "a", "b", "c")
+	if err := n.log.append(entries(1, 1, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	n.term, n.role = 2, leader
+	// Entry 1 of term 1 is on a majority, but a leader of term 2 may not
+	// count replicas of an older term's entry.
+	n.matchIndex["a"], n.matchIndex["b"] = 1, 1
+	n.advanceCommit()
+	if n.commitIndex != 0 {
+		t.Fatalf("committed entry of an earlier term: commit index %d", n.commitIndex)
+	}
+	// Once an entry of its own term is on a majority, everything before it
+	// commits with it.
+	if err := n.log.append(entries(2, 2, 2)...); err != nil {
+		t.Fatal(err)
+	}
+	n.matchIndex["a"] = 2
+	n.advanceCommit()
+	if n.commitIndex != 0 {
+		t.Fatalf("committed with only the leader holding entry 2")
+	}
+	n.matchIndex["c"] = 2
+	n.advanceCommit()
+	if n.commitIndex != 2 {
+		t.Fatalf("commit index %d, want 2", n.commitIndex)
+	}
+}
+
+func TestVote(t *testing.T) {
+	n := testNode(t, "v", "a", "b")
+	n.handleAppend(&AppendRequest{Term: 2, LeaderID: "a", Entries: append(entries(1, 1, 2), entries(2, 3, 3)...)})
+
+	// A candidate whose log is behind is refused.
+	if resp := n.handleVote(&VoteRequest{Term: 3, CandidateID: "a", LastLogIndex: 5, LastLogTerm: 1}); resp.Granted {
+		t.Fatalf("voted for a candidate with an older last term")
+	}
+	if resp := n.handleVote(&VoteRequest{Term: 3, CandidateID: "a", LastLogIndex: 2, LastLogTerm: 2}); resp.Granted {
+		t.Fatalf("voted for a candidate with a shorter log")
+	}
+	// One vote per term.
+	if resp := n.handleVote(&VoteRequest{Term: 3, CandidateID: "a", LastLogIndex: 3, LastLogTerm: 2}); !resp.Granted {
+		t.Fatalf("refused an up-to-date candidate")
+	}
+	if resp := n.handleVote(&VoteRequest{Term: 3, CandidateID: "b", LastLogIndex: 3, LastLogTerm: 2}); resp.Granted {
+		t.Fatalf("voted twice in term 3")
+	}
+	// A stale term is refused and answered with the current one.
+	if resp := n.handleVote(&VoteRequest{Term: 2, CandidateID: "b", LastLogIndex: 9, LastLogTerm: 9}); resp.Granted || resp.Term != 3 {
+		t.Fatalf("stale vote request: %+v", resp)
+	}
+	// The vote survives a restart.
+	hs, err := loadHardState(n.statePath)
+	if err != nil || hs.Term != 3 || hs.VotedFor != "a" {
+		t.Fatalf("hard state %+v, %v", hs, err)
+	}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	n := testNode(t, "f", "l")
+	var restored uint64
+	n.cfg.Restore = func(index uint64, r io.Reader) error {
+		restored = index
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	n.handleAppend(&AppendRequest{Term: 1, LeaderID: "l", Entries: entries(1, 1, 3)})
+	resp, err := n.handleSnapshot(&SnapshotRequest{Term: 2, LeaderID: "l", LastIndex: 10, LastTerm: 2}, bytes.NewReader(nil))
+	if err != nil || resp.Term != 2 {
+		t.Fatalf("install: %+v, %v", resp, err)
+	}
+	if restored != 10 || n.log.offset != 10 || n.log.lastIndex() != 10 || n.log.lastTerm() != 2 || n.commitIndex != 10 || n.lastApplied != 10 {
+		t.Fatalf("restored %d, log %d-%d, commit %d, applied %d", restored, n.log.offset, n.log.lastIndex(), n.commitIndex, n.lastApplied)
+	}
+	// An older snapshot is ignored.
+	restored = 0
+	if _, err := n.handleSnapshot(&SnapshotRequest{Term: 2, LeaderID: "l", LastIndex: 8, LastTerm: 2}, bytes.NewReader(nil)); err != nil || restored != 0 {
+		t.Fatalf("older snapshot restored: %d, %v", restored, err)
+	}
+	// The log continues after the snapshot, and entries it covers are
+	// skipped.
+	if resp := n.handleAppend(&AppendRequest{Term: 2, LeaderID: "l", PrevLogIndex: 8, PrevLogTerm: 2, Entries: entries(2, 9, 12)}); !resp.Success || resp.LastIndex != 12 {
+		t.Fatalf("append across the snapshot: success %v, last index %d", resp.Success, resp.LastIndex)
+	}
+
+	// The log follows the snapshot after a restart.
+	n.log.close()
+	n2, err := NewNode(Config{ID: "f", Peers: []string{"f", "l"}, Dir: n.cfg.Dir, Applied: 12, Apply: n.cfg.Apply})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.log = n2.log
+	if n2.log.offset != 10 || n2.log.lastIndex() != 12 || n2.lastApplied != 12 {
+		t.Fatalf("after restart: log %d-%d, applied %d", n2.log.offset, n2.log.lastIndex(), n2.lastApplied)
+	}
+}
+
+func TestInterruptedInstall(t *testing.T) {
+	for _, tc := range []struct {
+		applied    uint64
+		wantOffset uint64
+	}{
+		{applied: 3, wantOffset: 0},   // the state machine never took it
+		{applied: 10, wantOffset: 10}, // the log was not reset yet
+	} {
+		dir := t.TempDir()
+		lg, err := openLog(dir, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lg.append(entries(1, 1, 5)...); err != nil {
+			t.Fatal(err)
+		}
+		lg.close()
+		if err := saveJSON(filepath.Join(dir, "install.json"), install{Index: 10, Term: 2}); err != nil {
+			t.Fatal(err)
+		}
+		n, err := NewNode(Config{ID: "f", Peers: []string{"f", "l"}, Dir: dir, Applied: tc.applied, Apply: func(uint64, []byte) (any, error) { return nil, nil }})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.log.offset != tc.wantOffset {
+			t.Fatalf("applied %d: log offset %d, want %d", tc.applied, n.log.offset, tc.wantOffset)
+		}
+		if _, err := os.Stat(n.installPath); !os.IsNotExist(err) {
+			t.Fatalf("install record left behind: %v", err)
+		}
+		n.log.close()
+	}
+}
+
+// cluster is a set of started nodes talking over loopback HTTP.
+type cluster struct {
+	t       *testing.T
+	ids     []string
+	nodes   map[string]*Node
+	servers map[string]*http.Server
+	mu      sync.Mutex
+	applied map[string][]string
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	c := &cluster{t: t, nodes: map[string]*Node{}, servers: map[string]*http.Server{}, applied: map[string][]string{}}
+	var lns []net.Listener
+	var ids []string
+	for i := 0; i < size; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+		ids = append(ids, ln.Addr().String())
+	}
+	c.ids = ids
+	for i, id := range ids {
+		c.start(id, lns[i])
+	}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start runs node id on ln from an empty data directory. Its state machine
+// is the list of entries it has applied.
+func (c *cluster) start(id string, ln net.Listener) {
+	c.mu.Lock()
+	delete(c.applied, id)
+	c.mu.Unlock()
+	n, err := NewNode(Config{
+		ID:                id,
+		Peers:             c.ids,
+		Dir:               c.t.TempDir(),
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 30 * time.Millisecond,
+		RPCTimeout:        200 * time.Millisecond,
+		Apply: func(_ uint64, data []byte) (any, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.applied[id] = append(c.applied[id], string(data))
+			return len(c.applied[id]), nil
+		},
+		Snapshot: func() (io.ReadCloser, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			data, err := json.Marshal(c.applied[id])
+			return io.NopCloser(bytes.NewReader(data)), err
+		},
+		Restore: func(_ uint64, r io.Reader) error {
+			var applied []string
+			if err := json.NewDecoder(r).Decode(&applied); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.applied[id] = applied
+			return nil
+		},
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	n.Register(mux)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	c.nodes[id], c.servers[id] = n, srv
+	n.Start()
+}
+
+func (c *cluster) stop(id string) {
+	if srv, ok := c.servers[id]; ok {
+		srv.Close()
+		delete(c.servers, id)
+		c.nodes[id].Stop()
+		delete(c.nodes, id)
+	}
+}
+
+// leader waits until exactly one running node leads and every running node
+// agrees on it.
+func (c *cluster) leader() *Node {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		agreed := true
+		for _, n := range c.nodes {
+			if n.IsLeader() {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) == 1 {
+			for _, n := range c.nodes {
+				agreed = agreed && n.Leader() == leaders[0].cfg.ID
+			}
+			if agreed {
+				return leaders[0]
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatalf("no single leader elected")
+	return nil
+}
+
+func (c *cluster) waitApplied(id string, want []string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		got := append([]string(nil), c.applied[id]...)
+		c.mu.Unlock()
+		if len(got) == len(want) {
+			for i := range want {
+				if got[i] != want[i] {
+					c.t.Fatalf("%s applied %v, want %v", id, got, want)
+				}
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatalf("%s did not apply %v", id, want)
+}
+
+func TestElectionAndReplication(t *testing.T) {
+	c := newCluster(t, 3)
+	l := c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := []string{"a", "b", "c"}
+	for i, d := range want {
+		v, err := l.Propose(ctx, []byte(d))
+		if err != nil {
+			t.Fatalf("propose %s: %v", d, err)
+		}
+		if v != i+1 {
+			t.Fatalf("propose %s returned %v", d, v)
+		}
+	}
+	for id := range c.nodes {
+		c.waitApplied(id, want)
+	}
+	for _, n := range c.nodes {
+		if n != l {
+			if _, err := n.Propose(ctx, []byte("x")); err != ErrNotLeader {
+				t.Fatalf("follower accepted a proposal: %v", err)
+			}
+		}
+	}
+}
+
+func TestReelectionAfterLeaderStops(t *testing.T) {
+	c := newCluster(t, 3)
+	old := c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := old.Propose(ctx, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	term := old.Term()
+	c.stop(old.cfg.ID)
+
+	l := c.leader()
+	if l.Term() <= term {
+		t.Fatalf("new leader in term %d, old leader was in %d", l.Term(), term)
+	}
+	if _, err := l.Propose(ctx, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	for id := range c.nodes {
+		c.waitApplied(id, []string{"before", "after"})
+	}
+}
+
+func TestWipedPeerCatchesUpFromSnapshot(t *testing.T) {
+	c := newCluster(t, 3)
+	l := c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := []string{"a", "b", "c"}
+	for _, d := range want {
+		if _, err := l.Propose(ctx, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := range c.nodes {
+		c.waitApplied(id, want)
+	}
+	if err := l.CompactLog(l.MatchedIndex()); err != nil {
+		t.Fatal(err)
+	}
+	if l.log.offset == 0 {
+		t.Fatalf("nothing compacted")
+	}
+
+	// A follower loses its data and comes back at the same address.
+	var id string
+	for p := range c.nodes {
+		if p != l.cfg.ID {
+			id = p
+			break
+		}
+	}
+	c.stop(id)
+	ln, err := net.Listen("tcp", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.start(id, ln)
+	want = append(want, "d")
+	if _, err := l.Propose(ctx, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied(id, want)
+}
@@ -0,0 +1,134 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	votePath     = "/raft/vote"
+	appendPath   = "/raft/append"
+	snapshotPath = "/raft/snapshot"
+	// snapshotHeader carries the SnapshotRequest; the body is the snapshot.
+	snapshotHeader = "X-Raft-Snapshot"
+)
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse carries the follower's last log index so a rejected leader
+// can skip straight back to it instead of probing one entry at a time.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// SnapshotRequest replaces the follower's log up to LastIndex, whose entry
+// is of LastTerm, with the state machine snapshot sent along with it.
+type SnapshotRequest struct {
+	Term      uint64 `json:"term"`
+	LeaderID  string `json:"leader_id"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Register mounts the peer RPC endpoints on mux.
+func (n *Node) Register(mux *http.ServeMux) {
+	mux.HandleFunc(votePath, func(w http.ResponseWriter, r *http.Request) {
+		var req VoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(n.handleVote(&req))
+	})
+	mux.HandleFunc(appendPath, func(w http.ResponseWriter, r *http.Request) {
+		var req AppendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(n.handleAppend(&req))
+	})
+	mux.HandleFunc(snapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		var req SnapshotRequest
+		if err := json.Unmarshal([]byte(r.Header.Get(snapshotHeader)), &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := n.handleSnapshot(&req, r.Body)
+		if err != nil {
+			log.Printf("raft: install snapshot from %s: %v", req.LeaderID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func (n *Node) call(peer, path string, in, out any) error {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+path, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return n.do(n.client, peer, path, req, out)
+}
+
+// callSnapshot streams body to peer as the snapshot described by in.
+func (n *Node) callSnapshot(peer string, in *SnapshotRequest, body io.Reader, out *SnapshotResponse) error {
+	meta, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+snapshotPath, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(snapshotHeader, string(meta))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return n.do(n.snapshotClient, peer, snapshotPath, req, out)
+}
+
+func (n *Node) do(client *http.Client, peer, path string, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("raft rpc %s to %s: http %d", path, peer, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
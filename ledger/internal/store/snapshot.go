@@ -0,0 +1,357 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"restreamx/ledger/internal/wal"
+	"restreamx/pkg/api"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	// restoreDir holds a snapshot from another node while it is received;
+	// its manifest, written last, lists the files to swap in.
+	restoreDir      = "restore"
+	restoreManifest = "MANIFEST"
+)
+
+// snapshot holds the lease and agent state as of raft index Applied. Segments
+// with a commit index below Compacted have been dropped from the log; those
+// at or above it are still read back from the log on Open. Txns are the
+// txn_ids appended since TxnCutoffMs, which outlive their segments.
+type snapshot struct {
+	Applied     uint64            `json:"applied"`
+	CommitIndex uint64            `json:"commit_index"`
+	Compacted   uint64            `json:"compacted"`
+	Leases      []*api.Lease      `json:"leases"`
+	Epochs      map[string]uint64 `json:"epochs"`
+	Heads       map[string]uint64 `json:"heads,omitempty"`
+	Agents      map[string]uint64 `json:"agents,omitempty"`
+	Txns        []snapshotTxn     `json:"txns,omitempty"`
+	TxnCutoffMs int64             `json:"txn_cutoff_ms,omitempty"`
+}
+
+type snapshotTxn struct {
+	RangeID     string `json:"range_id"`
+	TxnID       string `json:"txn_id"`
+	CommitIndex uint64 `json:"commit_index"`
+	AtMs        int64  `json:"at_ms"`
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	snap := &snapshot{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func saveSnapshot(path string, snap *snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile durably replaces the file at path with data.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// CompactedIndex returns the compaction watermark: the lowest commit index
+// that can still be read. It is 0 until the store is first compacted.
+func (s *Store) CompactedIndex() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compacted
+}
+
+// Compact drops every segment with a commit index below watermark and
+// forgets the txn_ids appended before txnCutoffMs, whatever their segments.
+// The lease, agent and txn state is written to a snapshot first, so log files
+// holding only older records can then be deleted. A watermark at or below the
+// current one is a no-op.
+func (s *Store) Compact(applied, watermark uint64, txnCutoffMs int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if watermark > s.commitIndex+1 {
+		watermark = s.commitIndex + 1
+	}
+	if watermark <= s.compacted {
+		s.applied = applied
+		return nil
+	}
+	s.txnCutoff = max(s.txnCutoff, txnCutoffMs)
+	for k, t := range s.txns {
+		if t.atMs < s.txnCutoff {
+			delete(s.txns, k)
+		}
+	}
+	if err := saveSnapshot(filepath.Join(s.dir, snapshotFile), s.snapshot(applied, watermark)); err != nil {
+		return err
+	}
+	s.compacted = watermark
+	s.applied = applied
+
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].commitIndex >= watermark })
+	s.index = append([]indexEntry(nil), s.index[i:]...)
+	for r, entries := range s.byRange {
+		j := sort.Search(len(entries), func(j int) bool { return entries[j].commitIndex >= watermark })
+		if j == len(entries) {
+			delete(s.byRange, r)
+			continue
+		}
+		s.byRange[r] = append([]indexEntry(nil), entries[j:]...)
+	}
+	if len(s.index) == 0 {
+		// Everything is compacted: only the active file is kept.
+		return s.log.RemoveBefore(^uint64(0))
+	}
+	return s.log.RemoveBefore(s.index[0].pos.File)
+}
+
+// snapshot returns the state other than segments, as of raft index applied
+// with segments below compacted dropped. The caller holds s.mu.
+func (s *Store) snapshot(applied, compacted uint64) *snapshot {
+	snap := &snapshot{Applied: applied, CommitIndex: s.commitIndex, Compacted: compacted, Epochs: s.epochs, Heads: s.heads, Agents: s.agents, TxnCutoffMs: s.txnCutoff}
+	for _, lease := range s.leases {
+		snap.Leases = append(snap.Leases, lease)
+	}
+	for k, t := range s.txns {
+		snap.Txns = append(snap.Txns, snapshotTxn{RangeID: k.rangeID, TxnID: k.txnID, CommitIndex: t.commitIndex, AtMs: t.atMs})
+	}
+	return snap
+}
+
+// Snapshot returns the whole store as of its last applied raft index, for a
+// raft peer that needs entries compacted away: a line holding the snapshot,
+// then the log record of every segment not compacted, one per line. It must
+// not run concurrently with an apply. The segments are read as the stream is
+// consumed; a compaction meanwhile fails it.
+func (s *Store) Snapshot() (io.ReadCloser, error) {
+	s.mu.Lock()
+	meta, err := json.Marshal(s.snapshot(s.applied, s.compacted))
+	positions := make([]wal.Position, len(s.index))
+	for i, e := range s.index {
+		positions[i] = e.pos
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriterSize(pw, 64<<10)
+		write := func(data []byte) error {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			return w.WriteByte('\n')
+		}
+		err := write(meta)
+		for _, pos := range positions {
+			if err != nil {
+				break
+			}
+			var data []byte
+			if data, err = s.log.ReadAt(pos); err == nil {
+				err = write(data)
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// Restore replaces the store with a stream written by Snapshot on another
+// node, as of raft index applied. The stream is staged in a directory of its
+// own and swapped in only once complete, so a crash leaves either the old
+// store or the new one.
+func (s *Store) Restore(applied uint64, r io.Reader) error {
+	staging := filepath.Join(s.dir, restoreDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	if err := stage(staging, applied, r); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.log.Close(); err != nil {
+		return err
+	}
+	st, err := Open(s.dir)
+	if err != nil {
+		return err
+	}
+	s.log, s.commitIndex, s.applied, s.compacted = st.log, st.commitIndex, st.applied, st.compacted
+	s.leases, s.epochs, s.heads, s.agents = st.leases, st.epochs, st.heads, st.agents
+	s.index, s.byRange, s.txns, s.txnCutoff = st.index, st.byRange, st.txns, st.txnCutoff
+	close(s.changed)
+	s.changed = make(chan struct{})
+	close(s.leaseChange)
+	s.leaseChange = make(chan struct{})
+	return nil
+}
+
+// stage writes the snapshot stream r into dir as a store of its own, then
+// the manifest that marks it complete.
+func stage(dir string, applied uint64, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("snapshot header: %w", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(line, &snap); err != nil {
+		return err
+	}
+	snap.Applied = applied
+	log, err := wal.Open(dir, wal.DefaultMaxFileSize)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("snapshot segments: %w", err)
+		}
+		data := bytes.TrimSuffix(line, []byte{'\n'})
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		if rec.Segment == nil {
+			return errors.New("snapshot holds a record that is not a segment")
+		}
+		if err := rec.Segment.VerifyChecksum(); err != nil {
+			return fmt.Errorf("snapshot segment %d: %w", rec.Segment.CommitIndex, err)
+		}
+		if _, err := log.Append(data); err != nil {
+			return err
+		}
+	}
+	if err := log.Sync(); err != nil {
+		return err
+	}
+	if err := saveSnapshot(filepath.Join(dir, snapshotFile), &snap); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, e := range entries {
+		if storeFile(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+	manifest, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, restoreManifest), manifest)
+}
+
+func storeFile(name string) bool {
+	return name == snapshotFile || strings.HasSuffix(name, ".wal")
+}
+
+// finishRestore swaps a complete staged restore into dir: the store files it
+// does not replace are removed, then the staged ones are moved in. An
+// incomplete one is discarded. It is safe to repeat after a crash part way.
+func finishRestore(dir string) error {
+	staging := filepath.Join(dir, restoreDir)
+	data, err := os.ReadFile(filepath.Join(staging, restoreManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(staging)
+	}
+	if err != nil {
+		return err
+	}
+	var files []string
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, f := range files {
+		keep[f] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if storeFile(e.Name()) && !keep[e.Name()] {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		if err := os.Rename(filepath.Join(staging, f), filepath.Join(dir, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
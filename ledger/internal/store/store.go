@@ -3,53 +3,176 @@ package store
 import (
 	"encoding/json"
 	"errors"
-	"os"
+	"fmt"
+	"path/filepath"
+	"sort"
 	"sync"
 
+	"restreamx/ledger/internal/wal"
 	"restreamx/pkg/api"
 )
 
-type snapshot struct {
-	CommitIndex uint64                `json:"commit_index"`
-	Leases      map[string]*api.Lease `json:"leases"`
-	Segments    []*api.Segment        `json:"segments"`
+// record is the unit written to the write-ahead log; exactly one of Lease,
+// Segment and Agent is set. Applied is the raft log index the record was
+// applied from. AtMs is the leader's clock when a segment was appended.
+type record struct {
+	Applied uint64       `json:"applied,omitempty"`
+	AtMs    int64        `json:"at_ms,omitempty"`
+	Lease   *api.Lease   `json:"lease,omitempty"`
+	Segment *api.Segment `json:"segment,omitempty"`
+	Agent   *agentAck    `json:"agent,omitempty"`
+}
+
+// agentAck records the commit index an agent has applied through. Removed
+// drops the agent from the set that holds back compaction.
+type agentAck struct {
+	ID      string `json:"id"`
+	Applied uint64 `json:"applied"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+type txnKey struct {
+	rangeID string
+	txnID   string
+}
+
+// txnEntry is the segment a txn_id was appended as, and when.
+type txnEntry struct {
+	commitIndex uint64
+	atMs        int64
+}
+
+type indexEntry struct {
+	commitIndex uint64
+	pos         wal.Position
 }
 
 type Store struct {
 	mu          sync.Mutex
-	path        string
+	dir         string
+	log         *wal.Log
 	commitIndex uint64
+	applied     uint64
+	compacted   uint64
 	leases      map[string]*api.Lease
-	segments    []*api.Segment
+	epochs      map[string]uint64
+	heads       map[string]uint64 // last commit index of each range
+	agents      map[string]uint64
+	index       []indexEntry
+	byRange     map[string][]indexEntry
+	txns        map[txnKey]txnEntry
+	txnCutoff   int64 // txn_ids appended before it are forgotten
+	changed     chan struct{}
+	leaseChange chan struct{}
 }
 
-func Open(path string) (*Store, error) {
-	st := &Store{path: path, leases: map[string]*api.Lease{}, segments: []*api.Segment{}}
-	if _, err := os.Stat(path); err == nil {
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil, err
+// Open opens the ledger stored in dir. It loads the last snapshot, if any, and
+// replays the log on top of it to rebuild the lease table and the
+// commit_index to log position index.
+func Open(dir string) (*Store, error) {
+	if err := finishRestore(dir); err != nil {
+		return nil, err
+	}
+	snap, err := loadSnapshot(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	log, err := wal.Open(dir, wal.DefaultMaxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	st := &Store{
+		dir:         dir,
+		log:         log,
+		commitIndex: snap.CommitIndex,
+		applied:     snap.Applied,
+		compacted:   snap.Compacted,
+		leases:      map[string]*api.Lease{},
+		epochs:      map[string]uint64{},
+		heads:       map[string]uint64{},
+		agents:      map[string]uint64{},
+		byRange:     map[string][]indexEntry{},
+		txns:        map[txnKey]txnEntry{},
+		txnCutoff:   snap.TxnCutoffMs,
+		changed:     make(chan struct{}),
+		leaseChange: make(chan struct{}),
+	}
+	for _, lease := range snap.Leases {
+		st.leases[lease.RangeId] = lease
+	}
+	for r, e := range snap.Epochs {
+		st.epochs[r] = e
+	}
+	for r, h := range snap.Heads {
+		st.heads[r] = h
+	}
+	for id, a := range snap.Agents {
+		st.agents[id] = a
+	}
+	for _, t := range snap.Txns {
+		st.txns[txnKey{t.RangeID, t.TxnID}] = txnEntry{commitIndex: t.CommitIndex, atMs: t.AtMs}
+	}
+	err = log.Replay(func(pos wal.Position, data []byte) error {
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
 		}
-		var snap snapshot
-		if err := json.Unmarshal(data, &snap); err != nil {
-			return nil, err
+		if rec.Applied > st.applied {
+			st.applied = rec.Applied
 		}
-		st.commitIndex = snap.CommitIndex
-		st.leases = snap.Leases
-		st.segments = snap.Segments
+		switch {
+		case rec.Segment != nil:
+			if rec.Segment.CommitIndex >= st.compacted {
+				st.indexSegment(rec.Segment, pos, rec.AtMs)
+			}
+			st.heads[rec.Segment.RangeId] = max(st.heads[rec.Segment.RangeId], rec.Segment.CommitIndex)
+		case rec.Applied <= snap.Applied:
+			// Already reflected in the snapshot.
+		case rec.Lease != nil:
+			st.setLease(rec.Lease)
+		case rec.Agent != nil:
+			st.setAgent(rec.Agent)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Close()
+		return nil, err
 	}
 	return st, nil
 }
 
-func (s *Store) Close() error { return nil }
+func (s *Store) Close() error { return s.log.Close() }
 
-func (s *Store) persist() error {
-	snap := snapshot{CommitIndex: s.commitIndex, Leases: s.leases, Segments: s.segments}
-	data, err := json.MarshalIndent(snap, "", "  ")
+func (s *Store) indexSegment(seg *api.Segment, pos wal.Position, atMs int64) {
+	e := indexEntry{commitIndex: seg.CommitIndex, pos: pos}
+	s.index = append(s.index, e)
+	s.byRange[seg.RangeId] = append(s.byRange[seg.RangeId], e)
+	if seg.TxnId != "" && atMs >= s.txnCutoff {
+		s.txns[txnKey{seg.RangeId, seg.TxnId}] = txnEntry{commitIndex: seg.CommitIndex, atMs: atMs}
+	}
+	if seg.CommitIndex > s.commitIndex {
+		s.commitIndex = seg.CommitIndex
+	}
+}
+
+func (s *Store) write(rec *record) (wal.Position, error) {
+	data, err := json.Marshal(rec)
 	if err != nil {
-		return err
+		return wal.Position{}, err
+	}
+	pos, err := s.log.Append(data)
+	if err != nil {
+		return wal.Position{}, err
 	}
-	return os.WriteFile(s.path, data, 0644)
+	return pos, s.log.Sync()
+}
+
+// AppliedIndex returns the highest raft log index reflected in the store.
+func (s *Store) AppliedIndex() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applied
 }
 
 func (s *Store) GetCommitIndex() (uint64, error) {
@@ -58,21 +181,47 @@ func (s *Store) GetCommitIndex() (uint64, error) {
 	return s.commitIndex, nil
 }
 
+// NextCommitIndex reserves the next commit index. The reservation becomes
+// durable only once a segment carrying it is written with PutSegment.
 func (s *Store) NextCommitIndex() (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.commitIndex++
-	if err := s.persist(); err != nil {
-		return 0, err
-	}
 	return s.commitIndex, nil
 }
 
-func (s *Store) PutLease(lease *api.Lease) error {
+func (s *Store) PutLease(applied uint64, lease *api.Lease) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if _, err := s.write(&record{Applied: applied, Lease: lease}); err != nil {
+		return err
+	}
+	s.setLease(lease)
+	s.applied = applied
+	close(s.leaseChange)
+	s.leaseChange = make(chan struct{})
+	return nil
+}
+
+func (s *Store) setLease(lease *api.Lease) {
 	s.leases[lease.RangeId] = lease
-	return s.persist()
+	if lease.Epoch > s.epochs[lease.RangeId] {
+		s.epochs[lease.RangeId] = lease.Epoch
+	}
+}
+
+// Head returns the commit index of rangeID's last segment, or 0.
+func (s *Store) Head(rangeID string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.heads[rangeID]
+}
+
+// Epoch returns the highest lease epoch ever granted for rangeID, or 0.
+func (s *Store) Epoch(rangeID string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.epochs[rangeID]
 }
 
 func (s *Store) GetLease(rangeID string) (*api.Lease, error) {
@@ -85,21 +234,191 @@ func (s *Store) GetLease(rangeID string) (*api.Lease, error) {
 	return lease, nil
 }
 
-func (s *Store) PutSegment(seg *api.Segment) error {
+// PutSegment stores seg, appended at atMs by the leader's clock.
+func (s *Store) PutSegment(applied uint64, seg *api.Segment, atMs int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.segments = append(s.segments, seg)
-	return s.persist()
+	if n := len(s.index); n > 0 && seg.CommitIndex <= s.index[n-1].commitIndex {
+		return fmt.Errorf("segment commit index %d not after %d", seg.CommitIndex, s.index[n-1].commitIndex)
+	}
+	pos, err := s.write(&record{Applied: applied, AtMs: atMs, Segment: seg})
+	if err != nil {
+		return err
+	}
+	s.indexSegment(seg, pos, atMs)
+	s.heads[seg.RangeId] = seg.CommitIndex
+	s.applied = applied
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
 }
 
-func (s *Store) ListSegments(from uint64) ([]*api.Segment, error) {
+// PutAgentAck records that agent id has applied segments through commit index
+// applied. Acknowledgements never move backwards.
+func (s *Store) PutAgentAck(applied uint64, id string, index uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	out := []*api.Segment{}
-	for _, seg := range s.segments {
-		if seg.CommitIndex >= from {
-			out = append(out, seg)
+	if cur, ok := s.agents[id]; ok && index < cur {
+		index = cur
+	}
+	ack := &agentAck{ID: id, Applied: index}
+	if _, err := s.write(&record{Applied: applied, Agent: ack}); err != nil {
+		return err
+	}
+	s.setAgent(ack)
+	s.applied = applied
+	return nil
+}
+
+// RemoveAgent forgets agent id so it no longer holds back compaction.
+func (s *Store) RemoveAgent(applied uint64, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ack := &agentAck{ID: id, Removed: true}
+	if _, err := s.write(&record{Applied: applied, Agent: ack}); err != nil {
+		return err
+	}
+	s.setAgent(ack)
+	s.applied = applied
+	return nil
+}
+
+func (s *Store) setAgent(ack *agentAck) {
+	if ack.Removed {
+		delete(s.agents, ack.ID)
+		return
+	}
+	s.agents[ack.ID] = ack.Applied
+}
+
+// Agents returns the last acknowledged commit index of every registered agent.
+func (s *Store) Agents() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]uint64, len(s.agents))
+	for id, a := range s.agents {
+		out[id] = a
+	}
+	return out
+}
+
+// LookupTxn returns the commit index of the segment already stored for txnID
+// in rangeID, if any. Compaction keeps txn_ids, even of dropped segments,
+// until they are older than its txn cutoff.
+func (s *Store) LookupTxn(rangeID, txnID string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.txns[txnKey{rangeID, txnID}]
+	return t.commitIndex, ok
+}
+
+// Changed returns a channel that is closed when the next segment is stored.
+// Take it before reading so a segment stored in between is not missed.
+func (s *Store) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// LeaseChanged returns a channel that is closed when the next lease is
+// stored. Take it before reading so a lease stored in between is not missed.
+func (s *Store) LeaseChanged() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaseChange
+}
+
+// LeasesAfter returns the leases whose revision is above after, in revision
+// order. When ranges is non-empty only those ranges' leases are returned.
+// Leases stored before revisions were recorded have none and are returned
+// only when after is 0.
+func (s *Store) LeasesAfter(after uint64, ranges []string) []*api.Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*api.Lease
+	add := func(lease *api.Lease) {
+		if lease != nil && (lease.Revision > after || (after == 0 && lease.Revision == 0)) {
+			out = append(out, lease)
+		}
+	}
+	if len(ranges) == 0 {
+		for _, lease := range s.leases {
+			add(lease)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, r := range ranges {
+			if !seen[r] {
+				seen[r] = true
+				add(s.leases[r])
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Revision < out[j].Revision })
+	return out
+}
+
+// ListSegments returns segments with commit index from onwards, at most limit
+// of them when limit is positive. When ranges is non-empty only segments of
+// those ranges are returned, read through the per-range index.
+func (s *Store) ListSegments(from uint64, ranges []string, limit int) ([]*api.Segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from < s.compacted {
+		return nil, api.ErrCompacted.Errorf("commit index %d is below the compaction watermark %d, bootstrap required", from, s.compacted)
+	}
+	var entries []indexEntry
+	if len(ranges) == 0 {
+		entries = tail(s.index, from, limit)
+	} else {
+		seen := map[string]bool{}
+		for _, r := range ranges {
+			if !seen[r] {
+				seen[r] = true
+				entries = append(entries, tail(s.byRange[r], from, limit)...)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].commitIndex < entries[j].commitIndex })
+		if limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
 		}
 	}
+	out := make([]*api.Segment, 0, len(entries))
+	for _, e := range entries {
+		seg, err := s.readSegment(e.pos)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, seg)
+	}
 	return out, nil
 }
+
+// tail returns the entries of a commit-ordered index from commit index from
+// onwards, at most limit of them when limit is positive.
+func tail(index []indexEntry, from uint64, limit int) []indexEntry {
+	i := sort.Search(len(index), func(i int) bool { return index[i].commitIndex >= from })
+	out := index[i:]
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (s *Store) readSegment(pos wal.Position) (*api.Segment, error) {
+	data, err := s.log.ReadAt(pos)
+	if err != nil {
+		return nil, err
+	}
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.Segment == nil {
+		return nil, fmt.Errorf("no segment at %d:%d", pos.File, pos.Offset)
+	}
+	if err := rec.Segment.VerifyChecksum(); err != nil {
+		return nil, fmt.Errorf("segment %d at %d:%d: %w", rec.Segment.CommitIndex, pos.File, pos.Offset, err)
+	}
+	return rec.Segment, nil
+}
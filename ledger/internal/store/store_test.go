@@ -0,0 +1,190 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"restreamx/pkg/api"
+)
+
+func putSegment(t *testing.T, s *Store, applied uint64, txnID string, atMs int64) uint64 {
+	t.Helper()
+	idx, err := s.NextCommitIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg := &api.Segment{RangeId: "r1", Epoch: 1, TxnId: txnID, CommitIndex: idx, PayloadType: "json"}
+	seg.Seal()
+	seg.SealCommit()
+	if err := s.PutSegment(applied, seg, atMs); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func reopen(t *testing.T, s *Store) *Store {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTxnsOutliveCompactedSegments(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, s, 1, "old", 1000)
+	recent := putSegment(t, s, 2, "recent", 5000)
+	putSegment(t, s, 3, "", 6000)
+
+	// Both segments are compacted away, but only "old" is past the cutoff.
+	if err := s.Compact(4, 3, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListSegments(recent, nil, 0); err == nil {
+		t.Fatalf("compacted segment still listed")
+	}
+	check := func(s *Store) {
+		t.Helper()
+		if _, ok := s.LookupTxn("r1", "old"); ok {
+			t.Fatalf("txn before the cutoff still deduplicated")
+		}
+		if idx, ok := s.LookupTxn("r1", "recent"); !ok || idx != recent {
+			t.Fatalf("recent txn: %d, %v, want %d", idx, ok, recent)
+		}
+	}
+	check(s)
+	check(reopen(t, s))
+}
+
+func TestTxnCutoffSurvivesReplay(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, s, 1, "a", 1000)
+	putSegment(t, s, 2, "b", 3000)
+	// The segments are still in the log, but "a" was forgotten by compaction
+	// and must stay forgotten when the log is replayed.
+	if err := s.Compact(3, 1, 2000); err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, s, 4, "c", 1500)
+	check := func(s *Store) {
+		t.Helper()
+		if _, ok := s.LookupTxn("r1", "a"); ok {
+			t.Fatalf("txn a deduplicated after its cutoff")
+		}
+		if _, ok := s.LookupTxn("r1", "c"); ok {
+			t.Fatalf("txn c appended before the cutoff deduplicated")
+		}
+		if _, ok := s.LookupTxn("r1", "b"); !ok {
+			t.Fatalf("txn b forgotten")
+		}
+	}
+	check(s)
+	check(reopen(t, s))
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.PutLease(1, &api.Lease{RangeId: "r1", OwnerId: "a", Epoch: 1}); err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, src, 2, "t1", 1000)
+	putSegment(t, src, 3, "t2", 1000)
+	if err := src.Compact(4, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	last := putSegment(t, src, 5, "t3", 1000)
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, dst, 1, "stale", 1000)
+	changed := dst.Changed()
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Restore(7, snap); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("restore did not wake waiters")
+	}
+	check := func(s *Store) {
+		t.Helper()
+		if s.AppliedIndex() != 7 || s.CompactedIndex() != 2 || s.Head("r1") != last {
+			t.Fatalf("applied %d, compacted %d, head %d", s.AppliedIndex(), s.CompactedIndex(), s.Head("r1"))
+		}
+		segs, err := s.ListSegments(2, nil, 0)
+		if err != nil || len(segs) != 2 || segs[0].TxnId != "t2" || segs[1].TxnId != "t3" {
+			t.Fatalf("segments %v, %v", segs, err)
+		}
+		for _, txn := range []string{"t1", "t2", "t3"} {
+			if _, ok := s.LookupTxn("r1", txn); !ok {
+				t.Fatalf("txn %s forgotten", txn)
+			}
+		}
+		if _, ok := s.LookupTxn("r1", "stale"); ok {
+			t.Fatalf("state from before the restore kept")
+		}
+		if lease, err := s.GetLease("r1"); err != nil || lease.OwnerId != "a" {
+			t.Fatalf("lease %+v, %v", lease, err)
+		}
+	}
+	check(dst)
+	check(reopen(t, dst))
+}
+
+func TestIncompleteRestoreDiscarded(t *testing.T) {
+	src, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	putSegment(t, src, 1, "new", 1000)
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegment(t, dst, 1, "old", 1000)
+	// The stream breaks off part way through the segment.
+	if err := dst.Restore(2, bytes.NewReader(data[:len(data)-5])); err == nil {
+		t.Fatalf("restored a truncated snapshot")
+	}
+	dst = reopen(t, dst)
+	if _, ok := dst.LookupTxn("r1", "old"); !ok {
+		t.Fatalf("old state lost")
+	}
+	if _, err := os.Stat(filepath.Join(dst.dir, restoreDir)); !os.IsNotExist(err) {
+		t.Fatalf("staging directory left behind: %v", err)
+	}
+}
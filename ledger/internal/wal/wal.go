@@ -0,0 +1,410 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Records are framed as a 4-byte little-endian payload length, a 4-byte
+// CRC32C of the payload, then the payload itself.
+const headerSize = 8
+
+const (
+	fileSuffix         = ".wal"
+	DefaultMaxFileSize = 64 << 20
+	maxRecordSize      = 256 << 20
+)
+
+var (
+	ErrCorrupt = errors.New("wal: corrupt record")
+	ErrClosed  = errors.New("wal: closed")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Position locates a record: the sequence number of the file holding it and
+// the byte offset of its header within that file.
+type Position struct {
+	File   uint64 `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+type Log struct {
+	mu          sync.Mutex
+	dir         string
+	maxFileSize int64
+	files       []uint64
+	active      *os.File
+	activeSeq   uint64
+	activeSize  int64
+	w           *bufio.Writer
+	readers     map[uint64]*os.File
+	closed      bool
+}
+
+// Open opens or creates the log in dir. A torn or corrupt record at the tail
+// of the newest file (a crash mid-append) is truncated away; corruption in
+// any older file is reported as ErrCorrupt.
+func Open(dir string, maxFileSize int64) (*Log, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, maxFileSize: maxFileSize, files: files, readers: map[uint64]*os.File{}}
+	if len(files) == 0 {
+		if err := l.createFile(1); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	last := files[len(files)-1]
+	valid, err := scanFile(l.path(last), nil)
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.path(last), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.active = f
+	l.activeSeq = last
+	l.activeSize = valid
+	l.w = bufio.NewWriterSize(f, 64<<10)
+	return l, nil
+}
+
+func listFiles(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []uint64{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, fileSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, seq)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+func (l *Log) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x%s", seq, fileSuffix))
+}
+
+func (l *Log) createFile(seq uint64) error {
+	f, err := os.OpenFile(l.path(seq), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		f.Close()
+		return err
+	}
+	l.files = append(l.files, seq)
+	l.active = f
+	l.activeSeq = seq
+	l.activeSize = 0
+	l.w = bufio.NewWriterSize(f, 64<<10)
+	return nil
+}
+
+func (l *Log) roll() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	return l.createFile(l.activeSeq + 1)
+}
+
+// Append buffers rec at the end of the log. It is not durable until Sync.
+func (l *Log) Append(rec []byte) (Position, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return Position{}, ErrClosed
+	}
+	if len(rec) > maxRecordSize {
+		return Position{}, fmt.Errorf("wal: record of %d bytes exceeds limit", len(rec))
+	}
+	if l.activeSize > 0 && l.activeSize+headerSize+int64(len(rec)) > l.maxFileSize {
+		if err := l.roll(); err != nil {
+			return Position{}, err
+		}
+	}
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(rec)))
+	binary.LittleEndian.PutUint32(hdr[4:8], crc32.Checksum(rec, castagnoli))
+	pos := Position{File: l.activeSeq, Offset: l.activeSize}
+	if _, err := l.w.Write(hdr[:]); err != nil {
+		return Position{}, err
+	}
+	if _, err := l.w.Write(rec); err != nil {
+		return Position{}, err
+	}
+	l.activeSize += headerSize + int64(len(rec))
+	return pos, nil
+}
+
+// Sync flushes buffered records and fsyncs the active file.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.active.Sync()
+}
+
+// ReadAt returns the record stored at pos, verifying its checksum.
+func (l *Log) ReadAt(pos Position) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if pos.File == l.activeSeq {
+		if err := l.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := l.reader(pos.File)
+	if err != nil {
+		return nil, err
+	}
+	var hdr [headerSize]byte
+	if _, err := f.ReadAt(hdr[:], pos.Offset); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	if size > maxRecordSize {
+		return nil, ErrCorrupt
+	}
+	rec := make([]byte, size)
+	if _, err := f.ReadAt(rec, pos.Offset+headerSize); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if crc32.Checksum(rec, castagnoli) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return nil, ErrCorrupt
+	}
+	return rec, nil
+}
+
+func (l *Log) reader(seq uint64) (*os.File, error) {
+	if f, ok := l.readers[seq]; ok {
+		return f, nil
+	}
+	f, err := os.Open(l.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	l.readers[seq] = f
+	return f, nil
+}
+
+// Replay calls fn for every record in log order.
+func (l *Log) Replay(fn func(pos Position, rec []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	for _, seq := range l.files {
+		if _, err := scanFile(l.path(seq), func(off int64, rec []byte) error {
+			return fn(Position{File: seq, Offset: off}, rec)
+		}); err != nil {
+			return fmt.Errorf("wal file %d: %w", seq, err)
+		}
+	}
+	return nil
+}
+
+// TruncateFrom discards the record at pos and everything after it.
+func (l *Log) TruncateFrom(pos Position) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	keep := []uint64{}
+	for _, seq := range l.files {
+		if seq > pos.File {
+			if f, ok := l.readers[seq]; ok {
+				f.Close()
+				delete(l.readers, seq)
+			}
+			if seq == l.activeSeq {
+				l.active.Close()
+			}
+			if err := os.Remove(l.path(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		keep = append(keep, seq)
+	}
+	l.files = keep
+	if l.activeSeq != pos.File {
+		f, err := os.OpenFile(l.path(pos.File), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		l.active = f
+		l.activeSeq = pos.File
+	}
+	if err := l.active.Truncate(pos.Offset); err != nil {
+		return err
+	}
+	if _, err := l.active.Seek(pos.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	l.activeSize = pos.Offset
+	l.w = bufio.NewWriterSize(l.active, 64<<10)
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	return syncDir(l.dir)
+}
+
+// RemoveBefore deletes every file older than file seq. The active file is
+// never removed.
+func (l *Log) RemoveBefore(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	keep := []uint64{}
+	for _, f := range l.files {
+		if f >= seq || f == l.activeSeq {
+			keep = append(keep, f)
+			continue
+		}
+		if r, ok := l.readers[f]; ok {
+			r.Close()
+			delete(l.readers, f)
+		}
+		if err := os.Remove(l.path(f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.files = keep
+	return syncDir(l.dir)
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	for _, f := range l.readers {
+		f.Close()
+	}
+	if err := l.w.Flush(); err != nil {
+		l.active.Close()
+		return err
+	}
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return err
+	}
+	return l.active.Close()
+}
+
+// scanFile walks the records of one file and returns the offset just past
+// the last intact record. A short or mismatched record stops the scan with
+// ErrCorrupt.
+func scanFile(path string, fn func(off int64, rec []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64<<10)
+	var off int64
+	var hdr [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return off, nil
+			}
+			return off, ErrCorrupt
+		}
+		size := binary.LittleEndian.Uint32(hdr[0:4])
+		if size > maxRecordSize {
+			return off, ErrCorrupt
+		}
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return off, ErrCorrupt
+		}
+		if crc32.Checksum(rec, castagnoli) != binary.LittleEndian.Uint32(hdr[4:8]) {
+			return off, ErrCorrupt
+		}
+		if fn != nil {
+			if err := fn(off, rec); err != nil {
+				return off, err
+			}
+		}
+		off += headerSize + int64(size)
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
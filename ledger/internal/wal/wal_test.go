@@ -0,0 +1,227 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func records(n int) [][]byte {
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = []byte(fmt.Sprintf("record %d", i))
+	}
+	return out
+}
+
+func appendAll(t *testing.T, l *Log, recs [][]byte) []Position {
+	t.Helper()
+	pos := make([]Position, len(recs))
+	for i, rec := range recs {
+		p, err := l.Append(rec)
+		if err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+		pos[i] = p
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	return pos
+}
+
+func replayAll(t *testing.T, l *Log) [][]byte {
+	t.Helper()
+	var out [][]byte
+	if err := l.Replay(func(_ Position, rec []byte) error {
+		out = append(out, append([]byte(nil), rec...))
+		return nil
+	}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return out
+}
+
+func checkRecords(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("record %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReplayAcrossFiles(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := records(20)
+	pos := appendAll(t, l, recs)
+	if pos[len(pos)-1].File == 1 {
+		t.Fatalf("expected the log to roll over to new files")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRecords(t, replayAll(t, l), recs)
+	for i, p := range pos {
+		rec, err := l.ReadAt(p)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(rec, recs[i]) {
+			t.Fatalf("read %d: got %q", i, rec)
+		}
+	}
+}
+
+func TestTornTailTruncated(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := records(3)
+	appendAll(t, l, recs)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash mid-append leaves a header promising more bytes than follow.
+	path := l.path(1)
+	intact, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, 'p', 'a', 'r'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatalf("open with torn tail: %v", err)
+	}
+	defer l.Close()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != intact.Size() {
+		t.Fatalf("file is %d bytes after recovery, want %d", st.Size(), intact.Size())
+	}
+	checkRecords(t, replayAll(t, l), recs)
+
+	// Appends resume right after the last intact record.
+	more := []byte("after recovery")
+	p := appendAll(t, l, [][]byte{more})[0]
+	if p.Offset != intact.Size() {
+		t.Fatalf("appended at %d, want %d", p.Offset, intact.Size())
+	}
+	checkRecords(t, replayAll(t, l), append(recs, more))
+}
+
+// corrupt flips a payload byte of the record at pos.
+func corrupt(t *testing.T, l *Log, pos Position) {
+	t.Helper()
+	f, err := os.OpenFile(l.path(pos.File), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	off := pos.Offset + headerSize
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRCMismatchAtTailTruncated(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := records(3)
+	pos := appendAll(t, l, recs)
+	l.Close()
+	corrupt(t, l, pos[2])
+
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRecords(t, replayAll(t, l), recs[:2])
+}
+
+func TestCRCMismatchInOlderFileReported(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := appendAll(t, l, records(10))
+	if pos[len(pos)-1].File == pos[0].File {
+		t.Fatalf("expected several files")
+	}
+	l.Close()
+	corrupt(t, l, pos[0])
+
+	l, err = Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := l.ReadAt(pos[0]); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("read corrupt record: got %v, want ErrCorrupt", err)
+	}
+	err = l.Replay(func(Position, []byte) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("replay: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestTruncateFrom(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := records(10)
+	pos := appendAll(t, l, recs)
+	if err := l.TruncateFrom(pos[4]); err != nil {
+		t.Fatal(err)
+	}
+	more := []byte("replacement")
+	appendAll(t, l, [][]byte{more})
+	l.Close()
+
+	l, err = Open(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkRecords(t, replayAll(t, l), append(recs[:4:4], more))
+}
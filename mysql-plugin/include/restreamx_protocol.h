@@ -7,5 +7,5 @@ struct restreamx_segment_header {
   const char *txn_id;
   uint64_t epoch;
   uint64_t commit_index;
-  uint32_t checksum;
+  uint32_t checksum; /* CRC32C, see api.SegmentChecksum in pkg/api */
 };
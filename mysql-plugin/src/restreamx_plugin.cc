@@ -1,11 +1,15 @@
 #include <mysql/plugin.h>
 #include <mysql/plugin_audit.h>
+#include <ctype.h>
 #include <string.h>
 
+#include <string>
+
 extern "C" {
 const char *restreamx_get_mode();
 const char *restreamx_get_node_id();
 const char *restreamx_get_ranges();
+const char *restreamx_get_replica_tables();
 const char *restreamx_get_socket_path();
 SYS_VAR **restreamx_sysvars();
 }
@@ -21,13 +25,78 @@ static bool is_write_query(const char *query) {
          !strncasecmp(query, "drop", 4);
 }
 
+// Words that may stand between a write's verb and the table it names.
+static const char *const table_prefixes[] = {
+  "into", "from", "table", "temporary", "if", "not", "exists",
+  "low_priority", "high_priority", "delayed", "quick", "ignore", nullptr,
+};
+
+static bool is_table_prefix(const std::string &word) {
+  for (const char *const *p = table_prefixes; *p; p++) {
+    if (!strcasecmp(word.c_str(), *p)) return true;
+  }
+  return false;
+}
+
+// read_ident reads an identifier at p, quoted with backticks or not, and
+// moves p past it.
+static bool read_ident(const char *&p, std::string &out) {
+  out.clear();
+  if (*p == '`') {
+    for (p++; *p; p++) {
+      if (*p == '`' && *++p != '`') return true;
+      out += *p;
+    }
+    return false;
+  }
+  while (isalnum((unsigned char)*p) || *p == '_' || *p == '$' || (unsigned char)*p >= 0x80) out += *p++;
+  return !out.empty();
+}
+
+// write_table returns the table a write statement names first, without its
+// database or quotes, or "" if it cannot tell.
+static std::string write_table(const char *p) {
+  std::string word;
+  while (isspace((unsigned char)*p)) p++;
+  read_ident(p, word);  // the verb
+  for (;;) {
+    while (isspace((unsigned char)*p)) p++;
+    bool quoted = *p == '`';
+    if (!read_ident(p, word)) return "";
+    if (!quoted && is_table_prefix(word)) continue;
+    while (*p == '.') {
+      p++;
+      if (!read_ident(p, word)) return "";
+    }
+    return word;
+  }
+}
+
+// writes_replica_table reports whether query writes a table listed in
+// restreamx.replica_tables.
+static bool writes_replica_table(const char *query) {
+  const char *list = restreamx_get_replica_tables();
+  if (!list || !*list) return false;
+  std::string table = write_table(query);
+  if (table.empty()) return false;
+  for (const char *p = list;;) {
+    const char *end = strchr(p, ',');
+    size_t n = end ? (size_t)(end - p) : strlen(p);
+    if (n == table.size() && !strncmp(p, table.data(), n)) return true;
+    if (!end) return false;
+    p = end + 1;
+  }
+}
+
 static int restreamx_audit_notify(MYSQL_THD, mysql_event_class_t event_class, const void *event) {
   if (event_class != MYSQL_AUDIT_GENERAL_CLASS) return 0;
   const struct mysql_event_general *ev = (const struct mysql_event_general *)event;
   if (!ev || !ev->general_query) return 0;
   const char *mode = restreamx_get_mode();
   if (!mode) return 0;
-  if (strcmp(mode, "REPLICA") == 0 && is_write_query(ev->general_query)) {
+  bool fenced = strcmp(mode, "REPLICA") == 0 ||
+                (strcmp(mode, "OWNER") == 0 && writes_replica_table(ev->general_query));
+  if (fenced && is_write_query(ev->general_query)) {
     if (ev->general_user && strcmp(ev->general_user, apply_user) == 0) {
       return 0;
     }
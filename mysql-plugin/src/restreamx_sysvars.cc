@@ -17,6 +17,8 @@ static char restreamx_lease_range_ids[512] = "";
 static char restreamx_ipc_socket_path[256] = "/var/run/restreamx.sock";
 static bool restreamx_lease_owner = false;
 static unsigned long long restreamx_lease_epoch = 0;
+static char *restreamx_lease_state = nullptr;
+static char *restreamx_replica_tables = nullptr;
 
 static int check_mode(MYSQL_THD, SYS_VAR *var, void *save, struct st_mysql_value *value) {
   char buff[16];
@@ -36,23 +38,32 @@ static void update_mode(MYSQL_THD, SYS_VAR *, void *var_ptr, const void *save) {
 static MYSQL_SYSVAR_STR(mode, restreamx_mode, PLUGIN_VAR_RQCMDARG, "ReStreamX mode", check_mode, update_mode, "OFF");
 static MYSQL_SYSVAR_STR(node_id, restreamx_node_id, PLUGIN_VAR_RQCMDARG, "ReStreamX node id", nullptr, nullptr, "");
 static MYSQL_SYSVAR_STR(lease_range_ids, restreamx_lease_range_ids, PLUGIN_VAR_RQCMDARG, "Range IDs", nullptr, nullptr, "");
+// Set by the router: the tables, comma separated, of ranges an OWNER node does
+// not own.
+static MYSQL_SYSVAR_STR(replica_tables, restreamx_replica_tables, PLUGIN_VAR_RQCMDARG | PLUGIN_VAR_MEMALLOC, "Tables written only by other owners", nullptr, nullptr, "");
 static MYSQL_SYSVAR_STR(ipc_socket_path, restreamx_ipc_socket_path, PLUGIN_VAR_RQCMDARG, "IPC socket", nullptr, nullptr, "/var/run/restreamx.sock");
-static MYSQL_SYSVAR_BOOL(lease_owner, restreamx_lease_owner, PLUGIN_VAR_READONLY, "Lease owner", nullptr, nullptr, 0);
-static MYSQL_SYSVAR_ULONGLONG(lease_epoch, restreamx_lease_epoch, PLUGIN_VAR_READONLY, "Lease epoch", nullptr, nullptr, 0, 0, ULLONG_MAX, 0);
+// Set at runtime by the node's agent from the ledger's lease watch, never
+// from the command line.
+static MYSQL_SYSVAR_BOOL(lease_owner, restreamx_lease_owner, PLUGIN_VAR_NOCMDOPT, "Lease owner", nullptr, nullptr, 0);
+static MYSQL_SYSVAR_ULONGLONG(lease_epoch, restreamx_lease_epoch, PLUGIN_VAR_NOCMDOPT, "Lease epoch", nullptr, nullptr, 0, 0, ULLONG_MAX, 0);
+static MYSQL_SYSVAR_STR(lease_state, restreamx_lease_state, PLUGIN_VAR_NOCMDOPT | PLUGIN_VAR_MEMALLOC, "Lease state per range", nullptr, nullptr, "");
 
 static SYS_VAR *restreamx_system_vars[] = {
   MYSQL_SYSVAR(mode),
   MYSQL_SYSVAR(node_id),
   MYSQL_SYSVAR(lease_range_ids),
+  MYSQL_SYSVAR(replica_tables),
   MYSQL_SYSVAR(ipc_socket_path),
   MYSQL_SYSVAR(lease_owner),
   MYSQL_SYSVAR(lease_epoch),
+  MYSQL_SYSVAR(lease_state),
   nullptr
 };
 
 const char *restreamx_get_mode() { return restreamx_mode; }
 const char *restreamx_get_node_id() { return restreamx_node_id; }
 const char *restreamx_get_ranges() { return restreamx_lease_range_ids; }
+const char *restreamx_get_replica_tables() { return restreamx_replica_tables; }
 const char *restreamx_get_socket_path() { return restreamx_ipc_socket_path; }
 void restreamx_set_lease_owner(bool owner) { restreamx_lease_owner = owner; }
 void restreamx_set_lease_epoch(unsigned long long epoch) { restreamx_lease_epoch = epoch; }
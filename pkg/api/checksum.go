@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SegmentChecksum computes the CRC32C of a segment's canonical encoding:
+// range_id, epoch, txn_id, payload_type and payload_bytes, with each string
+// and byte field prefixed by its little-endian uint32 length and the epoch as
+// a little-endian uint64. commit_index and prev_commit_index are covered by
+// SegmentCommitChecksum instead, because the ledger assigns them after the
+// writer has sealed the segment.
+func SegmentChecksum(seg *Segment) uint32 {
+	h := crc32.New(castagnoli)
+	var buf [8]byte
+	writeField := func(b []byte) {
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(b)))
+		h.Write(buf[:4])
+		h.Write(b)
+	}
+	writeField([]byte(seg.RangeId))
+	binary.LittleEndian.PutUint64(buf[:], seg.Epoch)
+	h.Write(buf[:])
+	writeField([]byte(seg.TxnId))
+	writeField([]byte(seg.PayloadType))
+	writeField(seg.PayloadBytes)
+	return h.Sum32()
+}
+
+// SegmentCommitChecksum computes the CRC32C the ledger seals a committed
+// segment's position with: the writer's checksum as a little-endian uint32,
+// then commit_index and prev_commit_index as little-endian uint64s.
+func SegmentCommitChecksum(seg *Segment) uint32 {
+	var buf [20]byte
+	binary.LittleEndian.PutUint32(buf[0:4], seg.Checksum)
+	binary.LittleEndian.PutUint64(buf[4:12], seg.CommitIndex)
+	binary.LittleEndian.PutUint64(buf[12:20], seg.PrevCommitIndex)
+	return crc32.Checksum(buf[:], castagnoli)
+}
+
+// Seal sets the segment's checksum from its current contents.
+func (s *Segment) Seal() {
+	s.Checksum = SegmentChecksum(s)
+}
+
+// SealCommit sets the commit checksum once the ledger has assigned the
+// segment's commit_index and prev_commit_index.
+func (s *Segment) SealCommit() {
+	s.CommitChecksum = SegmentCommitChecksum(s)
+}
+
+// VerifyChecksum returns ErrChecksumMismatch if the stored checksum does not
+// match the segment's contents or, once it is committed, the commit checksum
+// does not match its position.
+func (s *Segment) VerifyChecksum() error {
+	if sum := SegmentChecksum(s); sum != s.Checksum {
+		return ErrChecksumMismatch.Errorf("segment %s/%s checksum %08x, computed %08x", s.RangeId, s.TxnId, s.Checksum, sum)
+	}
+	if s.CommitIndex == 0 {
+		return nil
+	}
+	if sum := SegmentCommitChecksum(s); sum != s.CommitChecksum {
+		return ErrChecksumMismatch.Errorf("segment %d of %s commit checksum %08x, computed %08x", s.CommitIndex, s.RangeId, s.CommitChecksum, sum)
+	}
+	return nil
+}
@@ -4,20 +4,41 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// LeaderHeader is set by ledger followers on "not leader" responses to name
+// the node the request should be sent to instead.
+const LeaderHeader = "X-RestreamX-Leader"
+
 type Client struct {
-	baseURL string
-	client  *http.Client
+	mu        sync.Mutex
+	endpoints []string
+	current   int
+	timeout   time.Duration
+	client    *http.Client
 }
 
+// NewClient returns a client for the ledger. base may list several
+// comma-separated endpoints; requests follow leader redirects and move on to
+// the next endpoint when one is unreachable.
 func NewClient(base string, timeout time.Duration) *Client {
-	return &Client{baseURL: base, client: &http.Client{Timeout: timeout}}
+	endpoints := []string{}
+	for _, e := range strings.Split(base, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, strings.TrimSuffix(e, "/"))
+		}
+	}
+	return &Client{endpoints: endpoints, timeout: timeout, client: &http.Client{}}
 }
 
 func (c *Client) AcquireLease(ctx context.Context, req *AcquireLeaseRequest) (*Lease, error) {
@@ -29,7 +50,7 @@ func (c *Client) RenewLease(ctx context.Context, req *RenewLeaseRequest) (*Lease
 }
 
 func (c *Client) GetLease(ctx context.Context, rangeID string) (*Lease, error) {
-	u := fmt.Sprintf("%s/lease/get?range_id=%s", c.baseURL, url.QueryEscape(rangeID))
+	u := fmt.Sprintf("/lease/get?range_id=%s", url.QueryEscape(rangeID))
 	var out Lease
 	if err := c.doJSON(ctx, http.MethodGet, u, nil, &out); err != nil {
 		return nil, err
@@ -37,22 +58,74 @@ func (c *Client) GetLease(ctx context.Context, rangeID string) (*Lease, error) {
 	return &out, nil
 }
 
+// WatchLease returns the leases changed since req.AfterRevision, acquired or
+// renewed, in revision order. With WaitMs set the ledger holds the request
+// until a lease changes or the wait elapses, in which case the list is
+// empty. Pass the highest revision seen as the next AfterRevision.
+func (c *Client) WatchLease(ctx context.Context, req *WatchLeaseRequest) ([]*Lease, error) {
+	q := url.Values{}
+	q.Set("after_revision", strconv.FormatUint(req.AfterRevision, 10))
+	for _, r := range req.RangeIds {
+		q.Add("range_id", r)
+	}
+	if req.WaitMs > 0 {
+		q.Set("wait_ms", strconv.FormatInt(req.WaitMs, 10))
+	}
+	var out []*Lease
+	wait := time.Duration(req.WaitMs) * time.Millisecond
+	if err := c.request(ctx, c.timeout+wait, http.MethodGet, "/lease/watch?"+q.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *Client) AppendSegment(ctx context.Context, seg *Segment) (*AppendSegmentResponse, error) {
 	return post[Segment, AppendSegmentResponse](ctx, c, "/segment/append", seg)
 }
 
-func (c *Client) Subscribe(ctx context.Context, from uint64) ([]*Segment, error) {
-	u := fmt.Sprintf("%s/segment/subscribe?from_commit_index=%d", c.baseURL, from)
+// Subscribe returns the next page of segments from req.FromCommitIndex. With
+// WaitMs set the ledger holds the request until a segment is available or the
+// wait elapses, in which case the page is empty.
+func (c *Client) Subscribe(ctx context.Context, req *SubscribeRequest) ([]*Segment, error) {
+	q := subscribeQuery(req)
+	if req.Limit > 0 {
+		q.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.WaitMs > 0 {
+		q.Set("wait_ms", strconv.FormatInt(req.WaitMs, 10))
+	}
 	var out []*Segment
-	if err := c.doJSON(ctx, http.MethodGet, u, nil, &out); err != nil {
+	wait := time.Duration(req.WaitMs) * time.Millisecond
+	if err := c.request(ctx, c.timeout+wait, http.MethodGet, "/segment/subscribe?"+q.Encode(), nil, &out); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
+func subscribeQuery(req *SubscribeRequest) url.Values {
+	q := url.Values{}
+	q.Set("from_commit_index", strconv.FormatUint(req.FromCommitIndex, 10))
+	for _, r := range req.RangeIds {
+		q.Add("range_id", r)
+	}
+	return q
+}
+
+// AckAgent registers the agent, if it is not already, and records the commit
+// index it has applied through. The ledger never compacts segments that a
+// registered agent has not acknowledged.
+func (c *Client) AckAgent(ctx context.Context, req *AgentAckRequest) error {
+	return c.doJSON(ctx, http.MethodPost, "/agent/ack", req, nil)
+}
+
+// DeregisterAgent removes an agent so that it no longer holds back compaction.
+func (c *Client) DeregisterAgent(ctx context.Context, agentID string) error {
+	return c.doJSON(ctx, http.MethodPost, "/agent/deregister", &DeregisterAgentRequest{AgentId: agentID}, nil)
+}
+
 func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
 	var out StatusResponse
-	if err := c.doJSON(ctx, http.MethodGet, c.baseURL+"/status", nil, &out); err != nil {
+	if err := c.doJSON(ctx, http.MethodGet, "/status", nil, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
@@ -60,39 +133,111 @@ func (c *Client) Status(ctx context.Context) (*StatusResponse, error) {
 
 func post[In any, Out any](ctx context.Context, c *Client, path string, req *In) (*Out, error) {
 	var out Out
-	if err := c.doJSON(ctx, http.MethodPost, c.baseURL+path, req, &out); err != nil {
+	if err := c.doJSON(ctx, http.MethodPost, path, req, &out); err != nil {
 		return nil, err
 	}
 	return &out, nil
 }
 
-func (c *Client) doJSON(ctx context.Context, method, url string, in any, out any) error {
-	var body io.Reader
+func (c *Client) endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.current]
+}
+
+// redirect points the client at leader, or at the next configured endpoint
+// when the leader is unknown, unless another request already moved it off
+// failed.
+func (c *Client) redirect(failed, leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.endpoints[c.current] != failed {
+		return
+	}
+	if leader != "" {
+		for i, e := range c.endpoints {
+			if strings.TrimPrefix(strings.TrimPrefix(e, "http://"), "https://") == leader {
+				c.current = i
+				return
+			}
+		}
+	}
+	c.current = (c.current + 1) % len(c.endpoints)
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, in any, out any) error {
+	return c.request(ctx, c.timeout, method, path, in, out)
+}
+
+func (c *Client) request(ctx context.Context, timeout time.Duration, method, path string, in any, out any) error {
+	var buf []byte
 	if in != nil {
-		buf, err := json.Marshal(in)
-		if err != nil {
+		var err error
+		if buf, err = json.Marshal(in); err != nil {
 			return err
 		}
-		body = bytes.NewReader(buf)
 	}
-	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	var lastErr error
+	for attempt := 0; attempt <= len(c.endpoints); attempt++ {
+		base := c.endpoint()
+		retry, err := c.do(ctx, timeout, method, base, path, buf, out)
+		if err == nil || !retry || ctx.Err() != nil {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// do performs one request against base. It reports whether the request was
+// certainly not processed and may be retried against another endpoint.
+func (c *Client) do(ctx context.Context, timeout time.Duration, method, base, path string, body []byte, out any) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+path, rd)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if in != nil {
+	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return err
+		c.redirect(base, "")
+		return isDialError(err), err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		data, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("http %d: %s", resp.StatusCode, string(data))
+		err := responseError(resp)
+		if errors.Is(err, ErrNotLeader) {
+			c.redirect(base, resp.Header.Get(LeaderHeader))
+			return true, err
+		}
+		return false, err
 	}
 	if out == nil {
-		return nil
+		return false, nil
+	}
+	return false, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// responseError turns a failed response into an *Error when the body carries
+// an error code, and a plain error otherwise.
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	var apiErr Error
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Code == "" {
+		return fmt.Errorf("http %d: %s", resp.StatusCode, string(data))
 	}
-	return json.NewDecoder(resp.Body).Decode(out)
+	apiErr.Status = resp.StatusCode
+	return &apiErr
 }
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	CodeNotLeader     = "not_leader"
+	CodeLeaseConflict = "lease_conflict"
+	CodeLeaseNotFound = "lease_not_found"
+	CodeStaleEpoch    = "stale_epoch"
+	CodeChecksum      = "checksum_mismatch"
+	CodeCompacted     = "compacted"
+)
+
+// Error is the JSON body the ledger returns for failures a caller can act on.
+// Errors compare equal under errors.Is when their codes match, so callers can
+// test against the sentinels below.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	ErrNotLeader     = &Error{Status: http.StatusConflict, Code: CodeNotLeader, Message: "not leader"}
+	ErrLeaseConflict = &Error{Status: http.StatusConflict, Code: CodeLeaseConflict, Message: "lease held by another owner"}
+	ErrLeaseNotFound = &Error{Status: http.StatusNotFound, Code: CodeLeaseNotFound, Message: "lease not found"}
+	ErrStaleEpoch    = &Error{Status: http.StatusConflict, Code: CodeStaleEpoch, Message: "segment epoch is not the current lease epoch"}
+
+	ErrChecksumMismatch = &Error{Status: http.StatusBadRequest, Code: CodeChecksum, Message: "segment checksum mismatch"}
+	ErrCompacted        = &Error{Status: http.StatusGone, Code: CodeCompacted, Message: "compacted, bootstrap required"}
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errorf returns a copy of e with a more specific message.
+func (e *Error) Errorf(format string, args ...any) *Error {
+	return &Error{Status: e.Status, Code: e.Code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// streamIdleTimeout bounds how long a stream may go without receiving
+// anything, segments or keepalives, before it is treated as dead.
+const streamIdleTimeout = 30 * time.Second
+
+// SegmentStream iterates over segments pushed by the ledger's streaming
+// subscribe endpoint. It is not safe for concurrent use.
+type SegmentStream struct {
+	cancel  context.CancelFunc
+	body    *bufio.Reader
+	closer  func() error
+	idle    *time.Timer
+	lastErr error
+}
+
+// Stream opens a push subscription for the segments selected by req; Limit
+// and WaitMs are ignored. Segments arrive in commit order as they are
+// committed; call Next to receive them and Close when done.
+func (c *Client) Stream(ctx context.Context, req *SubscribeRequest) (*SegmentStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	path := "/segment/stream?" + subscribeQuery(req).Encode()
+	var lastErr error
+	for attempt := 0; attempt < len(c.endpoints); attempt++ {
+		base := c.endpoint()
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp, err := c.client.Do(httpReq)
+		if err != nil {
+			c.redirect(base, "")
+			lastErr = err
+			if isDialError(err) && ctx.Err() == nil {
+				continue
+			}
+			break
+		}
+		if resp.StatusCode >= 300 {
+			err := responseError(resp)
+			resp.Body.Close()
+			cancel()
+			return nil, err
+		}
+		return &SegmentStream{
+			cancel: cancel,
+			body:   bufio.NewReaderSize(resp.Body, 64<<10),
+			closer: resp.Body.Close,
+			idle:   time.AfterFunc(streamIdleTimeout, cancel),
+		}, nil
+	}
+	cancel()
+	return nil, lastErr
+}
+
+// Next blocks until the next segment arrives. Once it returns an error the
+// stream is finished and must be closed.
+func (s *SegmentStream) Next() (*Segment, error) {
+	if s.lastErr != nil {
+		return nil, s.lastErr
+	}
+	for {
+		line, err := s.body.ReadBytes('\n')
+		if err != nil {
+			s.lastErr = err
+			return nil, err
+		}
+		s.idle.Reset(streamIdleTimeout)
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var seg Segment
+		if err := json.Unmarshal(line, &seg); err != nil {
+			s.lastErr = err
+			return nil, err
+		}
+		return &seg, nil
+	}
+}
+
+func (s *SegmentStream) Close() error {
+	s.idle.Stop()
+	s.cancel()
+	return s.closer()
+}
@@ -1,25 +1,41 @@
 package api
 
+// Lease grants a range to an owner. Revision is the ledger log index of its
+// last change, acquisition or renewal, and only grows.
 type Lease struct {
 	RangeId  string `json:"range_id"`
 	OwnerId  string `json:"owner_id"`
 	Epoch    uint64 `json:"epoch"`
 	ExpiryMs int64  `json:"expiry_ms"`
+	Revision uint64 `json:"revision,omitempty"`
 }
 
+// Expired reports whether the lease has lapsed at nowMs (Unix milliseconds).
+func (l *Lease) Expired(nowMs int64) bool {
+	return l.ExpiryMs <= nowMs
+}
+
+// Segment is one write of a range. The ledger sets CommitIndex and
+// PrevCommitIndex, the commit index of the range's previous segment or 0 for
+// its first, so readers of a range can tell when they missed a segment.
 type Segment struct {
-	RangeId      string `json:"range_id"`
-	Epoch        uint64 `json:"epoch"`
-	TxnId        string `json:"txn_id"`
-	CommitIndex  uint64 `json:"commit_index"`
-	PayloadType  string `json:"payload_type"`
-	PayloadBytes []byte `json:"payload_bytes"`
-	Checksum     uint32 `json:"checksum"`
+	RangeId         string `json:"range_id"`
+	Epoch           uint64 `json:"epoch"`
+	TxnId           string `json:"txn_id"`
+	CommitIndex     uint64 `json:"commit_index"`
+	PrevCommitIndex uint64 `json:"prev_commit_index,omitempty"`
+	PayloadType     string `json:"payload_type"`
+	PayloadBytes    []byte `json:"payload_bytes"`
+	Checksum        uint32 `json:"checksum"`
+	CommitChecksum  uint32 `json:"commit_checksum,omitempty"`
 }
 
+// AcquireLeaseRequest succeeds only if the range has no unexpired lease, or
+// Epoch names the current lease's epoch to take it over explicitly.
 type AcquireLeaseRequest struct {
 	RangeId string `json:"range_id"`
 	OwnerId string `json:"owner_id"`
+	Epoch   uint64 `json:"epoch,omitempty"`
 	TtlMs   int64  `json:"ttl_ms"`
 }
 
@@ -34,17 +50,63 @@ type GetLeaseRequest struct {
 	RangeId string `json:"range_id"`
 }
 
+// AppendSegmentResponse reports the segment's commit index. Duplicate is set
+// when the range already had a segment with the same txn_id, in which case
+// CommitIndex is that segment's.
 type AppendSegmentResponse struct {
 	CommitIndex uint64 `json:"commit_index"`
+	Duplicate   bool   `json:"duplicate,omitempty"`
 }
 
+// SubscribeRequest selects segments from FromCommitIndex onwards; a non-empty
+// RangeIds restricts them to those ranges.
 type SubscribeRequest struct {
-	FromCommitIndex uint64 `json:"from_commit_index"`
+	FromCommitIndex uint64   `json:"from_commit_index"`
+	RangeIds        []string `json:"range_ids,omitempty"`
+	Limit           int      `json:"limit,omitempty"`
+	WaitMs          int64    `json:"wait_ms,omitempty"`
+}
+
+// WatchLeaseRequest selects the leases changed since AfterRevision; a
+// non-empty RangeIds restricts them to those ranges.
+type WatchLeaseRequest struct {
+	RangeIds      []string `json:"range_ids,omitempty"`
+	AfterRevision uint64   `json:"after_revision"`
+	WaitMs        int64    `json:"wait_ms,omitempty"`
+}
+
+// AgentAckRequest reports that an agent has applied every segment it
+// subscribes to through AppliedIndex. Registered agents hold back compaction.
+type AgentAckRequest struct {
+	AgentId      string `json:"agent_id"`
+	AppliedIndex uint64 `json:"applied_index"`
+}
+
+type DeregisterAgentRequest struct {
+	AgentId string `json:"agent_id"`
+}
+
+// AgentStatus is an agent's GET /status. Routers fail a range over to the
+// node whose agent has applied the most of it. Checkpoints holds the commit
+// index through which each range is applied, Epochs the highest epoch
+// applied in each range and LastEpoch the highest of them. While a segment
+// keeps failing to apply, StuckCommitIndex names it, StuckSeconds is how long
+// it has failed and LastError is its last failure.
+type AgentStatus struct {
+	AgentId          string            `json:"agent_id"`
+	AppliedIndex     uint64            `json:"applied_index"`
+	LastEpoch        uint64            `json:"last_epoch"`
+	Checkpoints      map[string]uint64 `json:"checkpoints,omitempty"`
+	Epochs           map[string]uint64 `json:"epochs,omitempty"`
+	StuckCommitIndex uint64            `json:"stuck_commit_index,omitempty"`
+	StuckSeconds     float64           `json:"stuck_seconds,omitempty"`
+	LastError        string            `json:"last_error,omitempty"`
 }
 
 type StatusResponse struct {
-	Leader      string   `json:"leader"`
-	Term        uint64   `json:"term"`
-	CommitIndex uint64   `json:"commit_index"`
-	Peers       []string `json:"peers"`
+	Leader         string   `json:"leader"`
+	Term           uint64   `json:"term"`
+	CommitIndex    uint64   `json:"commit_index"`
+	CompactedIndex uint64   `json:"compacted_index"`
+	Peers          []string `json:"peers"`
 }
@@ -0,0 +1,156 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	pluginNative      = "mysql_native_password"
+	pluginCachingSHA2 = "caching_sha2_password"
+
+	authMoreData      = 0x01
+	authSwitchRequest = 0xfe
+
+	// caching_sha2_password status bytes and the public key request.
+	cachingSHA2KeyReq = 2
+	cachingSHA2FastOK = 3
+	cachingSHA2Full   = 4
+)
+
+// scramble computes the auth response for plugin from the password and the
+// server's nonce.
+func scramble(plugin string, password string, nonce []byte) ([]byte, error) {
+	switch plugin {
+	case pluginNative:
+		return scrambleNative(password, nonce), nil
+	case pluginCachingSHA2:
+		return scrambleSHA2(password, nonce), nil
+	}
+	return nil, fmt.Errorf("mysql: unsupported auth plugin %q", plugin)
+}
+
+// scrambleNative is SHA1(password) XOR SHA1(nonce + SHA1(SHA1(password))).
+func scrambleNative(password string, nonce []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	h1 := sha1.Sum([]byte(password))
+	h2 := sha1.Sum(h1[:])
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write(h2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= h1[i]
+	}
+	return out
+}
+
+// scrambleSHA2 is SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce).
+func scrambleSHA2(password string, nonce []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	h1 := sha256.Sum256([]byte(password))
+	h2 := sha256.Sum256(h1[:])
+	h := sha256.New()
+	h.Write(h2[:])
+	h.Write(nonce)
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= h1[i]
+	}
+	return out
+}
+
+// encryptPassword encrypts the NUL-terminated password, XORed with the nonce,
+// under the server's RSA public key, as caching_sha2_password full
+// authentication requires on connections without TLS.
+func encryptPassword(password string, nonce []byte, pemKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("mysql: server sent no public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: server public key: %w", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("mysql: server public key is not RSA")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= nonce[i%len(nonce)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+// authenticate completes the authentication exchange after the handshake
+// response has been sent, following auth switches and caching_sha2_password's
+// extra round trips until the server answers OK or an error.
+func (c *Conn) authenticate(plugin string, nonce []byte) error {
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(pkt) == 0 {
+			return c.fail(errMalformed)
+		}
+		switch pkt[0] {
+		case okPacket:
+			return nil
+		case errPacket:
+			return parseError(pkt)
+		case authSwitchRequest:
+			r := &reader{buf: pkt[1:]}
+			plugin = r.nulString()
+			nonce = trimNonce(r.rest())
+			resp, err := scramble(plugin, c.cfg.Password, nonce)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(resp); err != nil {
+				return err
+			}
+		case authMoreData:
+			if plugin != pluginCachingSHA2 || len(pkt) < 2 {
+				return c.fail(fmt.Errorf("mysql: unexpected auth data for %s", plugin))
+			}
+			switch {
+			case pkt[1] == cachingSHA2FastOK && len(pkt) == 2:
+				// The OK packet follows.
+			case pkt[1] == cachingSHA2Full && len(pkt) == 2:
+				if err := c.writePacket([]byte{cachingSHA2KeyReq}); err != nil {
+					return err
+				}
+			default:
+				enc, err := encryptPassword(c.cfg.Password, nonce, pkt[1:])
+				if err != nil {
+					return err
+				}
+				if err := c.writePacket(enc); err != nil {
+					return err
+				}
+			}
+		default:
+			return c.fail(fmt.Errorf("mysql: unexpected auth packet 0x%02x", pkt[0]))
+		}
+	}
+}
+
+// trimNonce drops the NUL the server appends to the auth plugin data.
+func trimNonce(b []byte) []byte {
+	if n := len(b); n > 0 && b[n-1] == 0 {
+		return b[:n-1]
+	}
+	return b
+}
@@ -0,0 +1,51 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestScramble(t *testing.T) {
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	for _, tc := range []struct {
+		plugin, password, want string
+	}{
+		{pluginNative, "secret", "b32bb3a583e1340c0a1108d58b1be49781ad8c2f"},
+		{pluginNative, "pässwörd", "9891a8536587af22d12e126cf5f7a8ea86d63b0e"},
+		{pluginCachingSHA2, "secret", "746ebe205d56a0707acb3e796e834e0dd7b1d61743b26bd5202c7a623230c7c9"},
+		{pluginCachingSHA2, "pässwörd", "8526563d365f5cb2cf44b162e5251a5cc348e1a1afeec271669611d0fdac23f7"},
+		{pluginNative, "", ""},
+		{pluginCachingSHA2, "", ""},
+	} {
+		got, err := scramble(tc.plugin, tc.password, nonce)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.plugin, err)
+		}
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("%s %q: got %x, want %s", tc.plugin, tc.password, got, tc.want)
+		}
+	}
+	if _, err := scramble("mysql_clear_password", "secret", nonce); err == nil {
+		t.Error("unsupported plugin accepted")
+	}
+}
+
+func TestScrambleNativeVerifies(t *testing.T) {
+	// The server stores SHA1(SHA1(password)), PASSWORD('secret') without its
+	// '*', and checks SHA1(response XOR SHA1(nonce + stored)) against it.
+	stored, _ := hex.DecodeString("14E65567ABDB5135D0CFD9A70B3032C179A49EE7")
+	nonce := []byte("abcdefghijklmnopqrst")
+	resp := scrambleNative("secret", nonce)
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write(stored)
+	h1 := h.Sum(nil)
+	for i := range h1 {
+		h1[i] ^= resp[i]
+	}
+	if h2 := sha1.Sum(h1); !bytes.Equal(h2[:], stored) {
+		t.Errorf("server would reject %x", resp)
+	}
+}
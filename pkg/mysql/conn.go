@@ -0,0 +1,362 @@
+// Package mysql is a small MySQL client speaking the client/server protocol
+// directly: handshake and authentication (mysql_native_password and
+// caching_sha2_password), text queries, prepared statements with bound
+// parameters, and a connection pool with transactions.
+package mysql
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Capability flags.
+const (
+	clientLongPassword     = 0x00000001
+	clientLongFlag         = 0x00000004
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientMultiResults     = 0x00020000
+	clientPluginAuth       = 0x00080000
+	clientPluginAuthLenenc = 0x00200000
+)
+
+const (
+	serverStatusMoreResults = 0x0008
+	charsetUTF8MB4GeneralCI = 45
+	defaultTimeout          = 5 * time.Second
+	maxAllowedPacket        = 64 << 20
+)
+
+// Commands.
+const (
+	comQuit        = 0x01
+	comQuery       = 0x03
+	comPing        = 0x0e
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+)
+
+// Config describes how to reach and log in to a server.
+type Config struct {
+	Addr     string // host:port; the port defaults to 3306
+	User     string
+	Password string
+	Database string
+	// Timeout bounds dialing and, for calls whose context has no deadline,
+	// each command. Zero means 5s.
+	Timeout time.Duration
+}
+
+func (cfg *Config) timeout() time.Duration {
+	if cfg.Timeout > 0 {
+		return cfg.Timeout
+	}
+	return defaultTimeout
+}
+
+func (cfg *Config) addr() string {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return net.JoinHostPort(cfg.Addr, "3306")
+	}
+	return cfg.Addr
+}
+
+// Conn is a single client connection. It is not safe for concurrent use;
+// use a Pool to share connections.
+type Conn struct {
+	cfg      Config
+	nc       net.Conn
+	rd       *bufio.Reader
+	seq      byte
+	broken   bool
+	inTxn    bool
+	id       uint32
+	version  string
+	lastUsed time.Time
+	// stmts holds the statements prepared on the connection by query, and
+	// stmtOrder their queries, oldest first.
+	stmts     map[string]preparedStmt
+	stmtOrder []string
+}
+
+// Dial connects and authenticates. Sessions use UTC so that temporal values
+// read from one server can be written unchanged to another.
+func Dial(ctx context.Context, cfg Config) (*Conn, error) {
+	d := net.Dialer{Timeout: cfg.timeout()}
+	nc, err := d.DialContext(ctx, "tcp", cfg.addr())
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{cfg: cfg, nc: nc, rd: bufio.NewReaderSize(nc, 16<<10)}
+	c.setDeadline(ctx)
+	if err := c.handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if _, err := c.exec(ctx, "SET time_zone = '+00:00'"); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c.lastUsed = time.Now()
+	return c, nil
+}
+
+func (c *Conn) handshake() error {
+	pkt, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt) > 0 && pkt[0] == errPacket {
+		return parseError(pkt)
+	}
+	r := &reader{buf: pkt}
+	if v := r.byte1(); v != 10 {
+		return c.fail(fmt.Errorf("mysql: unsupported protocol version %d", v))
+	}
+	c.version = r.nulString()
+	c.id = r.uint32()
+	nonce := append([]byte{}, r.take(8)...)
+	r.take(1)
+	caps := uint32(r.uint16())
+	r.take(3) // charset, status
+	caps |= uint32(r.uint16()) << 16
+	authLen := int(r.byte1())
+	r.take(10)
+	plugin := pluginNative
+	if caps&clientSecureConnection != 0 {
+		n := authLen - 8
+		if n < 13 {
+			n = 13
+		}
+		nonce = append(nonce, trimNonce(r.take(n))...)
+	}
+	if caps&clientPluginAuth != 0 {
+		if p := r.nulString(); p != "" {
+			plugin = p
+		}
+	}
+	if r.err != nil {
+		return c.fail(r.err)
+	}
+	if caps&clientProtocol41 == 0 {
+		return c.fail(errors.New("mysql: server does not support protocol 4.1"))
+	}
+	if plugin != pluginNative && plugin != pluginCachingSHA2 {
+		// Answer with caching_sha2_password and let the server switch us to
+		// whatever the account needs.
+		plugin = pluginCachingSHA2
+	}
+	auth, err := scramble(plugin, c.cfg.Password, nonce)
+	if err != nil {
+		return err
+	}
+
+	flags := uint32(clientLongPassword | clientLongFlag | clientProtocol41 | clientTransactions |
+		clientSecureConnection | clientMultiResults | clientPluginAuth | clientPluginAuthLenenc)
+	if c.cfg.Database != "" {
+		flags |= clientConnectWithDB
+	}
+	flags &= caps | clientConnectWithDB
+	out := appendUint32(nil, flags)
+	out = appendUint32(out, maxAllowedPacket)
+	out = append(out, charsetUTF8MB4GeneralCI)
+	out = append(out, make([]byte, 23)...)
+	out = append(append(out, c.cfg.User...), 0)
+	out = appendLenencBytes(out, auth)
+	if c.cfg.Database != "" {
+		out = append(append(out, c.cfg.Database...), 0)
+	}
+	out = append(append(out, plugin...), 0)
+	if err := c.writePacket(out); err != nil {
+		return err
+	}
+	return c.authenticate(plugin, nonce)
+}
+
+// fail marks the connection unusable after a network or protocol error and
+// closes it.
+func (c *Conn) fail(err error) error {
+	if !c.broken {
+		c.broken = true
+		c.nc.Close()
+	}
+	return fmt.Errorf("%w: %v", ErrBadConn, err)
+}
+
+// setDeadline bounds the next command by ctx's deadline, or by the configured
+// timeout when ctx has none.
+func (c *Conn) setDeadline(ctx context.Context) {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		dl = time.Now().Add(c.cfg.timeout())
+	}
+	_ = c.nc.SetDeadline(dl)
+}
+
+// Close sends COM_QUIT and closes the connection.
+func (c *Conn) Close() error {
+	if c.broken {
+		return nil
+	}
+	c.broken = true
+	_ = c.nc.SetDeadline(time.Now().Add(time.Second))
+	_ = c.writeCommand(comQuit, nil)
+	return c.nc.Close()
+}
+
+// Ping checks that the connection is alive.
+func (c *Conn) Ping(ctx context.Context) error {
+	if c.broken {
+		return ErrBadConn
+	}
+	c.setDeadline(ctx)
+	if err := c.writeCommand(comPing, nil); err != nil {
+		return err
+	}
+	_, err := c.readResult(false)
+	return err
+}
+
+// Exec runs a statement that returns no rows. With args it is prepared and
+// executed with the arguments bound as parameters; without, it is sent as
+// text.
+func (c *Conn) Exec(ctx context.Context, query string, args ...any) (*Result, error) {
+	if len(args) > 0 {
+		return c.execStmt(ctx, query, args)
+	}
+	return c.exec(ctx, query)
+}
+
+// Query runs a statement and returns its rows, fully read. Arguments are
+// bound as with Exec.
+func (c *Conn) Query(ctx context.Context, query string, args ...any) (*Result, error) {
+	return c.Exec(ctx, query, args...)
+}
+
+func (c *Conn) exec(ctx context.Context, query string) (*Result, error) {
+	if c.broken {
+		return nil, ErrBadConn
+	}
+	c.setDeadline(ctx)
+	if err := c.writeCommand(comQuery, []byte(query)); err != nil {
+		return nil, err
+	}
+	return c.readResult(false)
+}
+
+// readResult reads the response to a query or statement execution. Further
+// result sets, which only stored procedures produce, are read and dropped.
+func (c *Conn) readResult(binary bool) (*Result, error) {
+	res, more, err := c.readOneResult(binary)
+	for err == nil && more {
+		_, more, err = c.readOneResult(binary)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Conn) readOneResult(binary bool) (*Result, bool, error) {
+	pkt, err := c.readPacket()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(pkt) == 0 {
+		return nil, false, c.fail(errMalformed)
+	}
+	switch pkt[0] {
+	case okPacket:
+		res, status, err := parseOK(pkt)
+		if err != nil {
+			return nil, false, c.fail(err)
+		}
+		return res, status&serverStatusMoreResults != 0, nil
+	case errPacket:
+		return nil, false, parseError(pkt)
+	}
+	r := &reader{buf: pkt}
+	n, _ := r.lenencInt()
+	if r.err != nil {
+		return nil, false, c.fail(r.err)
+	}
+	cols, err := c.readColumns(int(n))
+	if err != nil {
+		return nil, false, err
+	}
+	res := &Result{Columns: cols}
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(pkt) > 0 && pkt[0] == errPacket {
+			return nil, false, parseError(pkt)
+		}
+		if isEOF(pkt) {
+			status := uint16(0)
+			if len(pkt) >= 5 {
+				status = uint16(pkt[3]) | uint16(pkt[4])<<8
+			}
+			return res, status&serverStatusMoreResults != 0, nil
+		}
+		var row []any
+		if binary {
+			row, err = decodeBinaryRow(pkt, cols)
+		} else {
+			row, err = decodeTextRow(pkt, cols)
+		}
+		if err != nil {
+			return nil, false, c.fail(err)
+		}
+		res.Rows = append(res.Rows, row)
+	}
+}
+
+// readColumns reads n column definitions and the EOF packet that ends them.
+func (c *Conn) readColumns(n int) ([]Column, error) {
+	cols := make([]Column, 0, n)
+	for i := 0; i < n; i++ {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		col, err := parseColumn(pkt)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		cols = append(cols, col)
+	}
+	if n > 0 {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if !isEOF(pkt) {
+			return nil, c.fail(errMalformed)
+		}
+	}
+	return cols, nil
+}
+
+func isEOF(pkt []byte) bool {
+	return len(pkt) > 0 && pkt[0] == eofPacket && len(pkt) < maxEOFLength
+}
+
+func parseOK(pkt []byte) (*Result, uint16, error) {
+	r := &reader{buf: pkt[1:]}
+	affected, _ := r.lenencInt()
+	lastID, _ := r.lenencInt()
+	status := r.uint16()
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return &Result{AffectedRows: affected, LastInsertID: lastID}, status, nil
+}
@@ -0,0 +1,70 @@
+package mysql
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Server error numbers callers commonly need to tell apart.
+const (
+	CodeAccessDenied      = 1045
+	CodeBadDB             = 1049
+	CodeDupEntry          = 1062
+	CodeBadField          = 1054
+	CodeNoSuchTable       = 1146
+	CodeTableAccessDenied = 1142
+	CodeLockWaitTimeout   = 1205
+	CodeLockDeadlock      = 1213
+	CodeSpecificAccess    = 1227
+	CodeUnknownStmt       = 1243
+	CodeOptionPrevents    = 1290
+	CodeReadOnlyTxn       = 1792
+)
+
+// ErrBadConn is returned, wrapped, when the connection failed mid-command and
+// has been closed. Whether the statement took effect is unknown.
+var ErrBadConn = errors.New("mysql: bad connection")
+
+var ErrPoolClosed = errors.New("mysql: pool closed")
+
+// Error is an error packet returned by the server. The connection remains
+// usable after one.
+type Error struct {
+	Number   uint16
+	SQLState string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("mysql %d (%s): %s", e.Number, e.SQLState, e.Message)
+}
+
+// Retryable reports whether the statement failed only because of contention
+// with another transaction and can be retried as is.
+func (e *Error) Retryable() bool {
+	return e.Number == CodeLockDeadlock || e.Number == CodeLockWaitTimeout
+}
+
+// ErrorNumber returns the server error number carried by err, or 0 if err is
+// not a server error.
+func ErrorNumber(err error) uint16 {
+	var me *Error
+	if errors.As(err, &me) {
+		return me.Number
+	}
+	return 0
+}
+
+func parseError(pkt []byte) error {
+	r := &reader{buf: pkt[1:]}
+	e := &Error{Number: r.uint16()}
+	if len(r.buf) > 0 && r.buf[0] == '#' {
+		r.take(1)
+		e.SQLState = string(r.take(5))
+	}
+	e.Message = string(r.rest())
+	if r.err != nil {
+		return r.err
+	}
+	return e
+}
@@ -0,0 +1,210 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxPacketSize is the largest payload of a single protocol packet; longer
+// payloads are split into several.
+const maxPacketSize = 1<<24 - 1
+
+// First bytes of generic response packets. An EOF packet is told apart from a
+// row starting with a 0xfe length prefix by being shorter than 9 bytes.
+const (
+	okPacket     = 0x00
+	errPacket    = 0xff
+	eofPacket    = 0xfe
+	maxEOFLength = 9
+)
+
+var errMalformed = errors.New("mysql: malformed packet")
+
+// readPacket reads one logical packet, joining split packets.
+func (c *Conn) readPacket() ([]byte, error) {
+	var out []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+			return nil, c.fail(err)
+		}
+		size := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+		if hdr[3] != c.seq {
+			return nil, c.fail(fmt.Errorf("mysql: packet sequence %d, want %d", hdr[3], c.seq))
+		}
+		c.seq++
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, c.fail(err)
+		}
+		if out == nil {
+			out = buf
+		} else {
+			out = append(out, buf...)
+		}
+		if size < maxPacketSize {
+			return out, nil
+		}
+	}
+}
+
+// writePacket writes payload, splitting it as needed.
+func (c *Conn) writePacket(payload []byte) error {
+	for {
+		n := len(payload)
+		if n > maxPacketSize {
+			n = maxPacketSize
+		}
+		hdr := [4]byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq}
+		c.seq++
+		if _, err := c.nc.Write(append(hdr[:], payload[:n]...)); err != nil {
+			return c.fail(err)
+		}
+		payload = payload[n:]
+		if n < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+// writeCommand starts a new command exchange.
+func (c *Conn) writeCommand(cmd byte, body []byte) error {
+	c.seq = 0
+	return c.writePacket(append([]byte{cmd}, body...))
+}
+
+// reader decodes the fields of a packet in order. Decoding past the end sets
+// err and yields zero values, so callers check err once at the end.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte1() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// lenencInt reads a length-encoded integer; null reports the 0xfb NULL marker.
+func (r *reader) lenencInt() (v uint64, null bool) {
+	switch b := r.byte1(); b {
+	case 0xfb:
+		return 0, true
+	case 0xfc:
+		return uint64(r.uint16()), false
+	case 0xfd:
+		b := r.take(3)
+		if b == nil {
+			return 0, false
+		}
+		return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16, false
+	case 0xfe:
+		return r.uint64(), false
+	default:
+		return uint64(b), false
+	}
+}
+
+// lenencBytes reads a length-encoded string, returning nil for NULL.
+func (r *reader) lenencBytes() []byte {
+	n, null := r.lenencInt()
+	if null {
+		return nil
+	}
+	b := r.take(int(n))
+	if b == nil && r.err == nil {
+		return []byte{}
+	}
+	return b
+}
+
+func (r *reader) lenencString() string { return string(r.lenencBytes()) }
+
+// nulString reads a NUL-terminated string, or the rest of the packet if
+// there is no NUL.
+func (r *reader) nulString() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, b := range r.buf {
+		if b == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	s := string(r.buf)
+	r.buf = nil
+	return s
+}
+
+func (r *reader) rest() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte { return binary.LittleEndian.AppendUint16(b, v) }
+
+func appendUint32(b []byte, v uint32) []byte { return binary.LittleEndian.AppendUint32(b, v) }
+
+func appendUint64(b []byte, v uint64) []byte { return binary.LittleEndian.AppendUint64(b, v) }
+
+func appendLenencInt(b []byte, v uint64) []byte {
+	switch {
+	case v < 0xfb:
+		return append(b, byte(v))
+	case v <= 0xffff:
+		return appendUint16(append(b, 0xfc), uint16(v))
+	case v <= 0xffffff:
+		return append(b, 0xfd, byte(v), byte(v>>8), byte(v>>16))
+	default:
+		return appendUint64(append(b, 0xfe), v)
+	}
+}
+
+func appendLenencBytes(b, v []byte) []byte {
+	return append(appendLenencInt(b, uint64(len(v))), v...)
+}
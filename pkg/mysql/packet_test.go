@@ -0,0 +1,77 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+// bufConn is a net.Conn whose writes go to a buffer.
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func TestPacketSplitting(t *testing.T) {
+	for _, tc := range []struct {
+		size  int
+		parts []int
+	}{
+		{0, []int{0}},
+		{10, []int{10}},
+		{maxPacketSize - 1, []int{maxPacketSize - 1}},
+		// A payload of exactly the maximum is followed by an empty packet.
+		{maxPacketSize, []int{maxPacketSize, 0}},
+		{maxPacketSize + 10, []int{maxPacketSize, 10}},
+		{2 * maxPacketSize, []int{maxPacketSize, maxPacketSize, 0}},
+	} {
+		payload := make([]byte, tc.size)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+		nc := &bufConn{}
+		w := &Conn{nc: nc, seq: 3}
+		if err := w.writePacket(payload); err != nil {
+			t.Fatalf("size %d: %v", tc.size, err)
+		}
+		wire := nc.buf.Bytes()
+		for i, n := range tc.parts {
+			if len(wire) < 4 {
+				t.Fatalf("size %d: packet %d missing", tc.size, i)
+			}
+			size := int(wire[0]) | int(wire[1])<<8 | int(wire[2])<<16
+			if size != n || wire[3] != byte(3+i) {
+				t.Fatalf("size %d: packet %d has size %d and sequence %d, want %d and %d", tc.size, i, size, wire[3], n, 3+i)
+			}
+			wire = wire[4+min(size, len(wire)-4):]
+		}
+		if len(wire) != 0 {
+			t.Fatalf("size %d: %d bytes after the last packet", tc.size, len(wire))
+		}
+
+		r := &Conn{rd: bufio.NewReader(bytes.NewReader(nc.buf.Bytes())), seq: 3}
+		got, err := r.readPacket()
+		if err != nil {
+			t.Fatalf("size %d: read: %v", tc.size, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("size %d: read back %d bytes that differ", tc.size, len(got))
+		}
+		if r.seq != w.seq {
+			t.Errorf("size %d: reader at sequence %d, writer at %d", tc.size, r.seq, w.seq)
+		}
+	}
+}
+
+func TestLenencRoundTrip(t *testing.T) {
+	for _, v := range []uint64{0, 0xfa, 0xfb, 0xffff, 0x10000, 0xffffff, 0x1000000, 1<<64 - 1} {
+		r := &reader{buf: appendLenencInt(nil, v)}
+		got, null := r.lenencInt()
+		if got != v || null || r.err != nil || len(r.buf) != 0 {
+			t.Errorf("%d: read back %d (null %v, err %v, %d left)", v, got, null, r.err, len(r.buf))
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxOpen = 16
+	defaultMaxIdle = 4
+	// idlePing is how long a pooled connection may sit unused before it is
+	// pinged on checkout, catching connections the server has since closed.
+	idlePing = 30 * time.Second
+)
+
+// Pool shares persistent connections to one server. It is safe for
+// concurrent use.
+type Pool struct {
+	cfg     Config
+	maxIdle int
+	slots   chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a pool of at most maxOpen connections, keeping up to
+// maxIdle of them open between uses. Zero values pick small defaults.
+// Connections are dialed lazily.
+func NewPool(cfg Config, maxOpen, maxIdle int) *Pool {
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpen
+	}
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdle
+	}
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	return &Pool{cfg: cfg, maxIdle: maxIdle, slots: make(chan struct{}, maxOpen)}
+}
+
+// Conn checks out a connection. It must be returned with Release.
+func (p *Pool) Conn(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			<-p.slots
+			return nil, ErrPoolClosed
+		}
+		var c *Conn
+		if n := len(p.idle); n > 0 {
+			c = p.idle[n-1]
+			p.idle = p.idle[:n-1]
+		}
+		p.mu.Unlock()
+		if c == nil {
+			break
+		}
+		if time.Since(c.lastUsed) < idlePing || c.Ping(ctx) == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+	c, err := Dial(ctx, p.cfg)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Release returns c to the pool. Broken connections, and connections left
+// inside a transaction, are closed instead.
+func (p *Pool) Release(c *Conn) {
+	defer func() { <-p.slots }()
+	if c.broken || c.inTxn {
+		c.Close()
+		return
+	}
+	c.lastUsed = time.Now()
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Exec runs a statement on a pooled connection; see Conn.Exec.
+func (p *Pool) Exec(ctx context.Context, query string, args ...any) (*Result, error) {
+	c, err := p.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Release(c)
+	return c.Exec(ctx, query, args...)
+}
+
+// Query runs a statement on a pooled connection and returns its rows.
+func (p *Pool) Query(ctx context.Context, query string, args ...any) (*Result, error) {
+	return p.Exec(ctx, query, args...)
+}
+
+// Ping checks that the server answers on a pooled connection.
+func (p *Pool) Ping(ctx context.Context) error {
+	c, err := p.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Release(c)
+	return c.Ping(ctx)
+}
+
+// Begin starts a transaction on a dedicated connection, which returns to the
+// pool on Commit or Rollback.
+func (p *Pool) Begin(ctx context.Context) (*Tx, error) {
+	c, err := p.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.exec(ctx, "START TRANSACTION"); err != nil {
+		p.Release(c)
+		return nil, err
+	}
+	c.inTxn = true
+	return &Tx{pool: p, conn: c}, nil
+}
+
+// Close closes idle connections and makes further checkouts fail.
+// Connections in use are closed as they are released.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
+
+var ErrTxDone = errors.New("mysql: transaction already committed or rolled back")
+
+// Tx is a transaction on one pooled connection. It is not safe for
+// concurrent use.
+type Tx struct {
+	pool *Pool
+	conn *Conn
+}
+
+func (tx *Tx) Exec(ctx context.Context, query string, args ...any) (*Result, error) {
+	if tx.conn == nil {
+		return nil, ErrTxDone
+	}
+	return tx.conn.Exec(ctx, query, args...)
+}
+
+func (tx *Tx) Query(ctx context.Context, query string, args ...any) (*Result, error) {
+	return tx.Exec(ctx, query, args...)
+}
+
+func (tx *Tx) Commit(ctx context.Context) error {
+	return tx.end(ctx, "COMMIT")
+}
+
+// Rollback aborts the transaction. It is a no-op after Commit or Rollback, so
+// it can be deferred.
+func (tx *Tx) Rollback(ctx context.Context) error {
+	if tx.conn == nil {
+		return nil
+	}
+	return tx.end(ctx, "ROLLBACK")
+}
+
+func (tx *Tx) end(ctx context.Context, stmt string) error {
+	if tx.conn == nil {
+		return ErrTxDone
+	}
+	c := tx.conn
+	tx.conn = nil
+	_, err := c.exec(ctx, stmt)
+	if err == nil {
+		c.inTxn = false
+	}
+	tx.pool.Release(c)
+	if err != nil {
+		return fmt.Errorf("%s: %w", stmt, err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Column types.
+const (
+	typeDecimal    = 0x00
+	typeTiny       = 0x01
+	typeShort      = 0x02
+	typeLong       = 0x03
+	typeFloat      = 0x04
+	typeDouble     = 0x05
+	typeNull       = 0x06
+	typeTimestamp  = 0x07
+	typeLongLong   = 0x08
+	typeInt24      = 0x09
+	typeDate       = 0x0a
+	typeTime       = 0x0b
+	typeDateTime   = 0x0c
+	typeYear       = 0x0d
+	typeVarChar    = 0x0f
+	typeBit        = 0x10
+	typeJSON       = 0xf5
+	typeNewDecimal = 0xf6
+	typeEnum       = 0xf7
+	typeSet        = 0xf8
+	typeTinyBlob   = 0xf9
+	typeMediumBlob = 0xfa
+	typeLongBlob   = 0xfb
+	typeBlob       = 0xfc
+	typeVarString  = 0xfd
+	typeString     = 0xfe
+	typeGeometry   = 0xff
+)
+
+const (
+	flagUnsigned  = 0x0020
+	charsetBinary = 63
+)
+
+// Column describes one column of a result set.
+type Column struct {
+	Schema  string
+	Table   string
+	Name    string
+	Type    byte
+	Flags   uint16
+	Charset uint16
+}
+
+// Result is the outcome of a statement. Rows holds one slice per row with a
+// value per column: nil for NULL, int64 or uint64 for integer types, float64
+// for FLOAT and DOUBLE, time.Time (UTC) for DATE, DATETIME and TIMESTAMP,
+// []byte for binary strings and BIT, and string for everything else,
+// including DECIMAL and TIME.
+type Result struct {
+	Columns      []Column
+	Rows         [][]any
+	AffectedRows uint64
+	LastInsertID uint64
+}
+
+// Map returns row i keyed by column name.
+func (r *Result) Map(i int) map[string]any {
+	out := make(map[string]any, len(r.Columns))
+	for j, col := range r.Columns {
+		out[col.Name] = r.Rows[i][j]
+	}
+	return out
+}
+
+func parseColumn(pkt []byte) (Column, error) {
+	r := &reader{buf: pkt}
+	r.lenencBytes() // catalog
+	col := Column{Schema: r.lenencString(), Table: r.lenencString()}
+	r.lenencBytes() // original table
+	col.Name = r.lenencString()
+	r.lenencBytes() // original name
+	r.lenencInt()   // length of the fixed fields
+	col.Charset = r.uint16()
+	r.uint32() // column length
+	col.Type = r.byte1()
+	col.Flags = r.uint16()
+	return col, r.err
+}
+
+func decodeTextRow(pkt []byte, cols []Column) ([]any, error) {
+	r := &reader{buf: pkt}
+	row := make([]any, len(cols))
+	for i := range cols {
+		b := r.lenencBytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if b == nil {
+			continue
+		}
+		v, err := textValue(&cols[i], b)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", cols[i].Name, err)
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+func textValue(col *Column, b []byte) (any, error) {
+	switch col.Type {
+	case typeTiny, typeShort, typeLong, typeInt24, typeLongLong, typeYear:
+		if col.Flags&flagUnsigned != 0 {
+			return strconv.ParseUint(string(b), 10, 64)
+		}
+		return strconv.ParseInt(string(b), 10, 64)
+	case typeFloat, typeDouble:
+		return strconv.ParseFloat(string(b), 64)
+	case typeDate, typeDateTime, typeTimestamp:
+		return parseTime(string(b))
+	}
+	return bytesValue(col, b), nil
+}
+
+// bytesValue returns binary data as a copy and text as a string.
+func bytesValue(col *Column, b []byte) any {
+	if col.Charset == charsetBinary && col.Type != typeNewDecimal && col.Type != typeDecimal && col.Type != typeTime {
+		return append([]byte{}, b...)
+	}
+	return string(b)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "0000-00-00" || s == "0000-00-00 00:00:00" || len(s) > 19 && s[:19] == "0000-00-00 00:00:00" {
+		return time.Time{}, nil
+	}
+	layout := "2006-01-02"
+	if len(s) > len(layout) {
+		layout = "2006-01-02 15:04:05.999999"
+	}
+	return time.ParseInLocation(layout, s, time.UTC)
+}
+
+func decodeBinaryRow(pkt []byte, cols []Column) ([]any, error) {
+	if len(pkt) == 0 || pkt[0] != okPacket {
+		return nil, errMalformed
+	}
+	r := &reader{buf: pkt[1:]}
+	nulls := r.take((len(cols) + 7 + 2) / 8)
+	row := make([]any, len(cols))
+	for i := range cols {
+		if r.err != nil {
+			break
+		}
+		bit := i + 2
+		if nulls[bit/8]&(1<<(bit%8)) != 0 {
+			continue
+		}
+		row[i] = binaryValue(r, &cols[i])
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return row, nil
+}
+
+func binaryValue(r *reader, col *Column) any {
+	unsigned := col.Flags&flagUnsigned != 0
+	switch col.Type {
+	case typeTiny:
+		if unsigned {
+			return uint64(r.byte1())
+		}
+		return int64(int8(r.byte1()))
+	case typeShort, typeYear:
+		if unsigned {
+			return uint64(r.uint16())
+		}
+		return int64(int16(r.uint16()))
+	case typeLong, typeInt24:
+		if unsigned {
+			return uint64(r.uint32())
+		}
+		return int64(int32(r.uint32()))
+	case typeLongLong:
+		if unsigned {
+			return r.uint64()
+		}
+		return int64(r.uint64())
+	case typeFloat:
+		return float64(math.Float32frombits(r.uint32()))
+	case typeDouble:
+		return math.Float64frombits(r.uint64())
+	case typeDate, typeDateTime, typeTimestamp:
+		return binaryTime(r)
+	case typeTime:
+		return binaryDuration(r)
+	}
+	b := r.lenencBytes()
+	if b == nil {
+		return nil
+	}
+	return bytesValue(col, b)
+}
+
+func binaryTime(r *reader) time.Time {
+	n := int(r.byte1())
+	b := r.take(n)
+	if b == nil || n == 0 {
+		return time.Time{}
+	}
+	var hour, min, sec, usec int
+	if n >= 7 {
+		hour, min, sec = int(b[4]), int(b[5]), int(b[6])
+	}
+	if n >= 11 {
+		usec = int(uint32(b[7]) | uint32(b[8])<<8 | uint32(b[9])<<16 | uint32(b[10])<<24)
+	}
+	year := int(uint16(b[0]) | uint16(b[1])<<8)
+	return time.Date(year, time.Month(b[2]), int(b[3]), hour, min, sec, usec*1000, time.UTC)
+}
+
+// binaryDuration decodes a TIME value into MySQL's text form, [-]HHH:MM:SS[.ffffff].
+func binaryDuration(r *reader) string {
+	n := int(r.byte1())
+	b := r.take(n)
+	if b == nil || n == 0 {
+		return "00:00:00"
+	}
+	sign := ""
+	if b[0] == 1 {
+		sign = "-"
+	}
+	days := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16 | uint32(b[4])<<24
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, days*24+uint32(b[5]), b[6], b[7])
+	if n >= 12 {
+		s += fmt.Sprintf(".%06d", uint32(b[8])|uint32(b[9])<<8|uint32(b[10])<<16|uint32(b[11])<<24)
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const charsetUTF8MB4 = 255
+
+// rowColumns are the columns of the rows decoded below: an int, an unsigned
+// bigint, a double, a datetime, a varchar, a varbinary, a decimal, a time and
+// a nullable varchar.
+var rowColumns = []Column{
+	{Name: "i", Type: typeLong, Charset: charsetBinary},
+	{Name: "u", Type: typeLongLong, Flags: flagUnsigned, Charset: charsetBinary},
+	{Name: "f", Type: typeDouble, Charset: charsetBinary},
+	{Name: "at", Type: typeDateTime, Charset: charsetBinary},
+	{Name: "s", Type: typeVarString, Charset: charsetUTF8MB4},
+	{Name: "b", Type: typeVarString, Charset: charsetBinary},
+	{Name: "d", Type: typeNewDecimal, Charset: charsetBinary},
+	{Name: "t", Type: typeTime, Charset: charsetBinary},
+	{Name: "n", Type: typeVarString, Charset: charsetUTF8MB4},
+}
+
+var rowWant = []any{
+	int64(-7), uint64(1<<64 - 1), 0.25, time.Date(2024, 2, 29, 12, 4, 5, 6000, time.UTC),
+	"hé", []byte{0, 0xff}, "12.50", "-25:01:02.000003", nil,
+}
+
+func TestDecodeTextRow(t *testing.T) {
+	var pkt []byte
+	for _, v := range []string{"-7", "18446744073709551615", "0.25", "2024-02-29 12:04:05.000006", "hé", "\x00\xff", "12.50", "-25:01:02.000003"} {
+		pkt = appendLenencBytes(pkt, []byte(v))
+	}
+	pkt = append(pkt, 0xfb) // NULL
+	got, err := decodeTextRow(pkt, rowColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rowWant) {
+		t.Errorf("got  %#v\nwant %#v", got, rowWant)
+	}
+	if _, err := decodeTextRow(pkt[:len(pkt)-2], rowColumns); err == nil {
+		t.Error("truncated row decoded")
+	}
+}
+
+func TestDecodeBinaryRow(t *testing.T) {
+	pkt := []byte{
+		okPacket,
+		0x00, 0x04, // NULL bitmap, offset by 2: column 8
+		0xf9, 0xff, 0xff, 0xff, // -7
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // 1<<64 - 1
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xd0, 0x3f, // 0.25
+		0x0b, 0xe8, 0x07, 0x02, 0x1d, 0x0c, 0x04, 0x05, 0x06, 0x00, 0x00, 0x00,
+		0x03, 'h', 0xc3, 0xa9,
+		0x02, 0x00, 0xff,
+		0x05, '1', '2', '.', '5', '0',
+		0x0c, 0x01, 0x01, 0x00, 0x00, 0x00, 0x01, 0x01, 0x02, 0x03, 0x00, 0x00, 0x00,
+	}
+	got, err := decodeBinaryRow(pkt, rowColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rowWant) {
+		t.Errorf("got  %#v\nwant %#v", got, rowWant)
+	}
+	if _, err := decodeBinaryRow(pkt[:len(pkt)-1], rowColumns); err == nil {
+		t.Error("truncated row decoded")
+	}
+}
+
+func TestParseColumn(t *testing.T) {
+	var pkt []byte
+	for _, s := range []string{"def", "demo", "a", "accounts", "bal", "balance"} {
+		pkt = appendLenencBytes(pkt, []byte(s))
+	}
+	pkt = append(pkt, 0x0c)
+	pkt = appendUint16(pkt, charsetBinary)
+	pkt = appendUint32(pkt, 20)
+	pkt = append(pkt, typeLongLong)
+	pkt = appendUint16(pkt, flagUnsigned)
+	pkt = append(pkt, 0, 0, 0)
+	got, err := parseColumn(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Column{Schema: "demo", Table: "a", Name: "bal", Type: typeLongLong, Flags: flagUnsigned, Charset: charsetBinary}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxCachedStmts bounds the statements a connection keeps prepared.
+const maxCachedStmts = 256
+
+// preparedStmt is a statement prepared on a connection.
+type preparedStmt struct {
+	id     uint32
+	params int
+}
+
+// execStmt executes query with args bound to its placeholders, preparing it
+// first unless the connection has it prepared already.
+func (c *Conn) execStmt(ctx context.Context, query string, args []any) (*Result, error) {
+	if c.broken {
+		return nil, ErrBadConn
+	}
+	c.setDeadline(ctx)
+	res, err := c.execPrepared(query, args)
+	var me *Error
+	if errors.As(err, &me) && me.Number == CodeUnknownStmt {
+		// The server dropped the statement; prepare it again.
+		c.forgetStmt(query)
+		res, err = c.execPrepared(query, args)
+	}
+	return res, err
+}
+
+func (c *Conn) execPrepared(query string, args []any) (*Result, error) {
+	st, err := c.cachedStmt(query)
+	if err != nil {
+		return nil, err
+	}
+	if st.params != len(args) {
+		return nil, fmt.Errorf("mysql: statement has %d placeholders, got %d arguments", st.params, len(args))
+	}
+	body, err := appendExecute(nil, st.id, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeCommand(comStmtExecute, body); err != nil {
+		return nil, err
+	}
+	return c.readResult(true)
+}
+
+// cachedStmt returns query prepared on c, closing the oldest statement when
+// the cache is full.
+func (c *Conn) cachedStmt(query string) (preparedStmt, error) {
+	if st, ok := c.stmts[query]; ok {
+		return st, nil
+	}
+	if c.stmts == nil {
+		c.stmts = map[string]preparedStmt{}
+	}
+	if len(c.stmtOrder) >= maxCachedStmts {
+		oldest := c.stmtOrder[0]
+		c.stmtOrder = c.stmtOrder[1:]
+		if st, ok := c.stmts[oldest]; ok {
+			delete(c.stmts, oldest)
+			if err := c.writeCommand(comStmtClose, appendUint32(nil, st.id)); err != nil {
+				return preparedStmt{}, err
+			}
+		}
+	}
+	id, params, err := c.prepare(query)
+	if err != nil {
+		return preparedStmt{}, err
+	}
+	st := preparedStmt{id: id, params: params}
+	c.stmts[query] = st
+	c.stmtOrder = append(c.stmtOrder, query)
+	return st, nil
+}
+
+// forgetStmt drops query from the cache without closing it on the server.
+func (c *Conn) forgetStmt(query string) {
+	delete(c.stmts, query)
+	for i, q := range c.stmtOrder {
+		if q == query {
+			c.stmtOrder = append(c.stmtOrder[:i], c.stmtOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Conn) prepare(query string) (uint32, int, error) {
+	if err := c.writeCommand(comStmtPrepare, []byte(query)); err != nil {
+		return 0, 0, err
+	}
+	pkt, err := c.readPacket()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(pkt) > 0 && pkt[0] == errPacket {
+		return 0, 0, parseError(pkt)
+	}
+	if len(pkt) < 12 || pkt[0] != okPacket {
+		return 0, 0, c.fail(errMalformed)
+	}
+	r := &reader{buf: pkt[1:]}
+	id := r.uint32()
+	cols := int(r.uint16())
+	params := int(r.uint16())
+	// Parameter and column definitions follow; execution reports the columns
+	// again, so they are skipped here.
+	if _, err := c.readColumns(params); err != nil {
+		return 0, 0, err
+	}
+	if _, err := c.readColumns(cols); err != nil {
+		return 0, 0, err
+	}
+	return id, params, nil
+}
+
+// appendExecute encodes COM_STMT_EXECUTE for statement id with args.
+func appendExecute(b []byte, id uint32, args []any) ([]byte, error) {
+	b = appendUint32(b, id)
+	b = append(b, 0)       // no cursor
+	b = appendUint32(b, 1) // iteration count
+	if len(args) == 0 {
+		return b, nil
+	}
+	nulls := make([]byte, (len(args)+7)/8)
+	types := make([]byte, 0, 2*len(args))
+	var values []byte
+	for i, arg := range args {
+		var typ byte
+		var unsigned bool
+		switch v := arg.(type) {
+		case nil:
+			nulls[i/8] |= 1 << (i % 8)
+			typ = typeNull
+		case bool:
+			typ = typeTiny
+			if v {
+				values = append(values, 1)
+			} else {
+				values = append(values, 0)
+			}
+		case int:
+			typ, values = typeLongLong, appendUint64(values, uint64(v))
+		case int8:
+			typ, values = typeLongLong, appendUint64(values, uint64(v))
+		case int16:
+			typ, values = typeLongLong, appendUint64(values, uint64(v))
+		case int32:
+			typ, values = typeLongLong, appendUint64(values, uint64(v))
+		case int64:
+			typ, values = typeLongLong, appendUint64(values, uint64(v))
+		case uint:
+			typ, unsigned, values = typeLongLong, true, appendUint64(values, uint64(v))
+		case uint8:
+			typ, unsigned, values = typeLongLong, true, appendUint64(values, uint64(v))
+		case uint16:
+			typ, unsigned, values = typeLongLong, true, appendUint64(values, uint64(v))
+		case uint32:
+			typ, unsigned, values = typeLongLong, true, appendUint64(values, uint64(v))
+		case uint64:
+			typ, unsigned, values = typeLongLong, true, appendUint64(values, v)
+		case float32:
+			typ, values = typeDouble, appendUint64(values, math.Float64bits(float64(v)))
+		case float64:
+			typ, values = typeDouble, appendUint64(values, math.Float64bits(v))
+		case string:
+			typ, values = typeVarString, appendLenencBytes(values, []byte(v))
+		case []byte:
+			typ, values = typeBlob, appendLenencBytes(values, v)
+		case time.Time:
+			typ, values = typeDateTime, appendDateTime(values, v.UTC())
+		default:
+			return nil, fmt.Errorf("mysql: unsupported argument type %T", arg)
+		}
+		flags := byte(0)
+		if unsigned {
+			flags = 0x80
+		}
+		types = append(types, typ, flags)
+	}
+	b = append(b, nulls...)
+	b = append(b, 1) // types follow
+	b = append(b, types...)
+	return append(b, values...), nil
+}
+
+func appendDateTime(b []byte, t time.Time) []byte {
+	b = append(b, 11)
+	b = appendUint16(b, uint16(t.Year()))
+	b = append(b, byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+	return appendUint32(b, uint32(t.Nanosecond()/1000))
+}
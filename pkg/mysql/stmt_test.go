@@ -0,0 +1,145 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendExecute(t *testing.T) {
+	got, err := appendExecute(nil, 0x01020304, []any{
+		int64(-2), uint64(1<<64 - 1), nil, "hé", []byte{0, 0xff}, true, 0.5,
+		time.Date(2024, 2, 29, 13, 4, 5, 6000, time.FixedZone("", 3600)), nil, int32(7),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x04, 0x03, 0x02, 0x01, // statement id
+		0x00,                   // no cursor
+		0x01, 0x00, 0x00, 0x00, // iteration count
+		0x04, 0x01, // NULL bitmap: args 2 and 8
+		0x01, // types follow
+		typeLongLong, 0x00, typeLongLong, 0x80, typeNull, 0x00, typeVarString, 0x00,
+		typeBlob, 0x00, typeTiny, 0x00, typeDouble, 0x00, typeDateTime, 0x00,
+		typeNull, 0x00, typeLongLong, 0x00,
+		0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // -2
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // 1<<64 - 1
+		0x03, 'h', 0xc3, 0xa9, // "hé"
+		0x02, 0x00, 0xff, // the bytes
+		0x01,                                           // true
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe0, 0x3f, // 0.5
+		0x0b, 0xe8, 0x07, 0x02, 0x1d, 0x0c, 0x04, 0x05, 0x06, 0x00, 0x00, 0x00, // 2024-02-29 12:04:05.000006 UTC
+		0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 7
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n%x\nwant\n%x", got, want)
+	}
+}
+
+func TestAppendExecuteNoArgs(t *testing.T) {
+	got, err := appendExecute(nil, 9, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{9, 0, 0, 0, 0, 1, 0, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if _, err := appendExecute(nil, 9, []any{struct{}{}}); err == nil {
+		t.Error("unsupported argument accepted")
+	}
+}
+
+// stmtServer answers prepares and executes on a connection. Statements
+// prepared before drop is called are unknown to it from then on, as after a
+// server restart or a FLUSH.
+type stmtServer struct {
+	mu     sync.Mutex
+	next   uint32
+	live   map[uint32]bool
+	closed []uint32
+}
+
+func (s *stmtServer) serve(srv *Conn) {
+	for {
+		srv.seq = 0
+		pkt, err := srv.readPacket()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		switch pkt[0] {
+		case comStmtPrepare:
+			s.next++
+			s.live[s.next] = true
+			reply := append([]byte{okPacket}, appendUint32(nil, s.next)...)
+			srv.writePacket(append(reply, 0, 0, 0, 0, 0, 0, 0))
+		case comStmtExecute:
+			if id := binary.LittleEndian.Uint32(pkt[1:]); s.live[id] {
+				srv.writePacket([]byte{okPacket, 0, 0, 0, 0})
+			} else {
+				srv.writePacket(append([]byte{errPacket}, appendUint16(nil, CodeUnknownStmt)...))
+			}
+		case comStmtClose:
+			id := binary.LittleEndian.Uint32(pkt[1:])
+			delete(s.live, id)
+			s.closed = append(s.closed, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *stmtServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live = map[uint32]bool{}
+}
+
+func TestStmtCacheAfterUnknownStmt(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	s := &stmtServer{live: map[uint32]bool{}}
+	go s.serve(&Conn{nc: srv, rd: bufio.NewReader(srv)})
+	c := &Conn{nc: cli, rd: bufio.NewReader(cli)}
+	ctx := context.Background()
+	exec := func(query string) {
+		t.Helper()
+		if _, err := c.execStmt(ctx, query, nil); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		exec("SELECT 0")
+		s.drop()
+	}
+	exec("SELECT 0")
+	if len(c.stmtOrder) != 1 || len(c.stmts) != 1 {
+		t.Fatalf("cache holds %d statements in order %q", len(c.stmts), c.stmtOrder)
+	}
+	// Filling the cache evicts other statements, never one still cached.
+	for i := 1; i <= maxCachedStmts; i++ {
+		exec(fmt.Sprintf("SELECT %d", i))
+	}
+	if len(c.stmtOrder) != maxCachedStmts || len(c.stmts) != maxCachedStmts {
+		t.Fatalf("cache holds %d statements in order of %d", len(c.stmts), len(c.stmtOrder))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.closed {
+		for query, st := range c.stmts {
+			if st.id == id {
+				t.Errorf("closed statement %d of %q is still cached", id, query)
+			}
+		}
+	}
+	if st := c.stmts["SELECT 0"]; st.id != 0 {
+		t.Errorf("oldest statement not evicted")
+	}
+}
@@ -0,0 +1,180 @@
+package sqlstmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Segment payload types. A json payload is a single RowOp; a txn payload is
+// a Txn whose operations are applied together in one transaction.
+const (
+	PayloadJSON = "json"
+	PayloadTxn  = "txn"
+)
+
+// Txn is an ordered list of row operations committed atomically: the /txn
+// request body and the payload of a txn segment.
+type Txn struct {
+	Ops []RowOp `json:"ops"`
+}
+
+// DecodePayload returns the operations carried by a segment payload, decoded
+// with UseNumber and normalized.
+func DecodePayload(payloadType string, b []byte) ([]RowOp, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var ops []RowOp
+	switch payloadType {
+	case PayloadJSON:
+		var op RowOp
+		if err := dec.Decode(&op); err != nil {
+			return nil, err
+		}
+		ops = []RowOp{op}
+	case PayloadTxn:
+		var txn Txn
+		if err := dec.Decode(&txn); err != nil {
+			return nil, err
+		}
+		ops = txn.Ops
+	default:
+		return nil, fmt.Errorf("unknown payload type %q", payloadType)
+	}
+	for i := range ops {
+		ops[i].Normalize()
+	}
+	return ops, nil
+}
+
+// RowOp is one row change: the write API's request body and, once the router
+// has validated it, the payload of a json segment. Key holds the primary key
+// columns and Data the other columns to write.
+type RowOp struct {
+	Op    string         `json:"op"`
+	Table string         `json:"table"`
+	Key   map[string]any `json:"key,omitempty"`
+	Data  map[string]any `json:"data,omitempty"`
+	// ID is the single-column key of the original write API, read as
+	// Key{"id": ID}.
+	ID any `json:"id,omitempty"`
+}
+
+// Normalize folds the legacy ID field into Key.
+func (op *RowOp) Normalize() {
+	if op.ID != nil && len(op.Key) == 0 {
+		op.Key = map[string]any{"id": op.ID}
+	}
+	op.ID = nil
+}
+
+// Statement builds the statement applying op. With upsert an insert or
+// update overwrites the row or creates it, so a segment carrying the row
+// image can be replayed.
+func (op *RowOp) Statement(upsert bool) (Stmt, error) {
+	key, err := cols(op.Key)
+	if err != nil {
+		return Stmt{}, err
+	}
+	data, err := cols(op.Data)
+	if err != nil {
+		return Stmt{}, err
+	}
+	// Only an insert leaving an auto-increment key to the owner has no key.
+	if len(key) == 0 && (upsert || op.Op != "insert") {
+		return Stmt{}, fmt.Errorf("%s on %s has no key", op.Op, op.Table)
+	}
+	switch op.Op {
+	case "insert", "update":
+		if op.Op == "update" && len(data) == 0 {
+			return Stmt{}, fmt.Errorf("update on %s sets no columns", op.Table)
+		}
+		all := append(key, data...)
+		if !upsert {
+			if op.Op == "update" {
+				return Update(op.Table, data, key), nil
+			}
+			return Insert(op.Table, all), nil
+		}
+		update := make([]string, 0, len(data))
+		for _, c := range data {
+			update = append(update, c.Name)
+		}
+		if len(update) == 0 {
+			update = append(update, key[0].Name)
+		}
+		return Upsert(op.Table, all, update), nil
+	case "delete":
+		return Delete(op.Table, key), nil
+	}
+	return Stmt{}, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// cols returns m's columns sorted by name, with values ready to bind.
+func cols(m map[string]any) ([]Col, error) {
+	out := make([]Col, 0, len(m))
+	for name, v := range m {
+		bv, err := JSONValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+		out = append(out, Col{Name: name, Value: bv})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// AppliedTable records, on every MySQL node, the segments whose operations
+// the node has committed: the router writes the row in the owner's
+// transaction and agents in the transaction that applies the segment.
+const AppliedTable = "rlr_meta.applied_segments"
+
+// MarkApplied builds the AppliedTable row for a segment.
+func MarkApplied(rangeID string, epoch uint64, txnID string, commitIndex uint64) Stmt {
+	return Upsert(AppliedTable, []Col{
+		{Name: "range_id", Value: rangeID},
+		{Name: "epoch", Value: epoch},
+		{Name: "txn_id", Value: txnID},
+		{Name: "commit_index", Value: commitIndex},
+		{Name: "applied_at", Value: Expr("NOW()")},
+	}, []string{"commit_index"})
+}
+
+// CheckpointTable holds, on every MySQL node, the commit index through which
+// its agent has applied each range and the range's epoch there. The agent
+// resumes after it on restart.
+const CheckpointTable = "rlr_meta.checkpoints"
+
+// StreamRange is the CheckpointTable range_id of the agent's stream position:
+// the commit index through which every segment of its ranges is applied. No
+// range has an empty ID.
+const StreamRange = ""
+
+// DeadLetterTable holds the segments an agent quarantined instead of
+// applying, with the error that made it give up on each.
+const DeadLetterTable = "rlr_meta.dead_letters"
+
+// DeadLetter builds the DeadLetterTable row for a segment.
+func DeadLetter(rangeID string, commitIndex, epoch uint64, txnID, payloadType string, payload []byte, cause string) Stmt {
+	return Upsert(DeadLetterTable, []Col{
+		{Name: "range_id", Value: rangeID},
+		{Name: "commit_index", Value: commitIndex},
+		{Name: "epoch", Value: epoch},
+		{Name: "txn_id", Value: txnID},
+		{Name: "payload_type", Value: payloadType},
+		{Name: "payload", Value: payload},
+		{Name: "error", Value: cause},
+		{Name: "quarantined_at", Value: Expr("NOW()")},
+	}, []string{"error", "quarantined_at"})
+}
+
+// Checkpoint builds the CheckpointTable row for a range, applied through
+// commitIndex and at epoch.
+func Checkpoint(rangeID string, commitIndex, epoch uint64) Stmt {
+	return Upsert(CheckpointTable, []Col{
+		{Name: "range_id", Value: rangeID},
+		{Name: "commit_index", Value: commitIndex},
+		{Name: "epoch", Value: epoch},
+	}, []string{"commit_index", "epoch"})
+}
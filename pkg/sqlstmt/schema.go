@@ -0,0 +1,358 @@
+package sqlstmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"restreamx/pkg/mysql"
+)
+
+// ErrNoRow is returned by Image when the row to record does not exist.
+var ErrNoRow = errors.New("row not found")
+
+// ErrNoTable is returned by LoadTable for a table that does not exist or that
+// the user cannot see.
+var ErrNoTable = errors.New("table not found")
+
+// Column is a column as described by information_schema.
+type Column struct {
+	Name     string
+	DataType string // DATA_TYPE, e.g. "int" or "varchar"
+	Nullable bool
+	Unsigned bool
+	// AutoIncrement columns may be left out of an insert's key; the owner
+	// assigns them.
+	AutoIncrement bool
+	Collation     string // COLLATION_NAME, "" for columns that are not text
+}
+
+// Table is a table's columns in ordinal order and its primary key columns in
+// key order. Unique is set when it has a unique index besides the primary
+// key and Related when a foreign key refers from or to it: writes to
+// different primary keys of such a table can still depend on each other.
+type Table struct {
+	Name       string
+	Columns    []Column
+	PrimaryKey []string
+	Unique     bool
+	Related    bool
+	byName     map[string]*Column
+}
+
+// Querier runs a query; *mysql.Pool and *mysql.Tx implement it.
+type Querier interface {
+	Query(ctx context.Context, query string, args ...any) (*mysql.Result, error)
+}
+
+// LoadTable reads the definition of db.table from information_schema.
+func LoadTable(ctx context.Context, q Querier, db, table string) (*Table, error) {
+	res, err := q.Query(ctx, "SELECT COLUMN_NAME, DATA_TYPE, IS_NULLABLE, COLUMN_TYPE, EXTRA, COLLATION_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", db, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Rows) == 0 {
+		return nil, fmt.Errorf("%s.%s: %w", db, table, ErrNoTable)
+	}
+	t := &Table{Name: table, byName: map[string]*Column{}}
+	for _, row := range res.Rows {
+		t.Columns = append(t.Columns, Column{
+			Name:          str(row[0]),
+			DataType:      strings.ToLower(str(row[1])),
+			Nullable:      str(row[2]) == "YES",
+			Unsigned:      strings.Contains(strings.ToLower(str(row[3])), "unsigned"),
+			AutoIncrement: strings.Contains(strings.ToLower(str(row[4])), "auto_increment"),
+			Collation:     strings.ToLower(str(row[5])),
+		})
+	}
+	for i := range t.Columns {
+		t.byName[t.Columns[i].Name] = &t.Columns[i]
+	}
+	res, err = q.Query(ctx, "SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION", db, table)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range res.Rows {
+		t.PrimaryKey = append(t.PrimaryKey, str(row[0]))
+	}
+	if len(t.PrimaryKey) == 0 {
+		return nil, fmt.Errorf("%s.%s has no primary key", db, table)
+	}
+	res, err = q.Query(ctx, "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 0 AND INDEX_NAME <> 'PRIMARY'", db, table)
+	if err != nil {
+		return nil, err
+	}
+	t.Unique = count(res) > 0
+	res, err = q.Query(ctx, "SELECT COUNT(*) FROM information_schema.KEY_COLUMN_USAGE WHERE REFERENCED_TABLE_NAME IS NOT NULL AND ((TABLE_SCHEMA = ? AND TABLE_NAME = ?) OR (REFERENCED_TABLE_SCHEMA = ? AND REFERENCED_TABLE_NAME = ?))", db, table, db, table)
+	if err != nil {
+		return nil, err
+	}
+	t.Related = count(res) > 0
+	return t, nil
+}
+
+// count reads the result of a SELECT COUNT(*).
+func count(res *mysql.Result) int64 {
+	if len(res.Rows) == 0 || len(res.Rows[0]) == 0 {
+		return 0
+	}
+	switch v := res.Rows[0][0].(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	}
+	n, _ := strconv.ParseInt(str(res.Rows[0][0]), 10, 64)
+	return n
+}
+
+// information_schema columns are text in some server versions and binary in
+// others.
+func str(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// Column returns the named column, or nil.
+func (t *Table) Column(name string) *Column { return t.byName[name] }
+
+// Check validates op against the table: Key must name exactly the primary
+// key columns, except that an insert may leave out an auto-increment one,
+// and Data only other existing columns. Values are converted in
+// place to what the column type expects, so the op can be bound and
+// marshalled into a segment without losing precision.
+func (t *Table) Check(op *RowOp) error {
+	if op.Key == nil {
+		op.Key = map[string]any{}
+	}
+	n := 0
+	for _, name := range t.PrimaryKey {
+		v, ok := op.Key[name]
+		if !ok {
+			if op.Op == "insert" && t.byName[name].AutoIncrement {
+				continue
+			}
+			return fmt.Errorf("key must have the primary key columns %s", strings.Join(t.PrimaryKey, ", "))
+		}
+		n++
+		if v == nil {
+			return fmt.Errorf("key column %s is null", name)
+		}
+		cv, err := t.byName[name].Value(v)
+		if err != nil {
+			return err
+		}
+		op.Key[name] = cv
+	}
+	if n != len(op.Key) {
+		return fmt.Errorf("key must have the primary key columns %s", strings.Join(t.PrimaryKey, ", "))
+	}
+	for name, v := range op.Data {
+		col := t.byName[name]
+		if col == nil {
+			return fmt.Errorf("table %s has no column %s", t.Name, name)
+		}
+		if t.isKey(name) {
+			return fmt.Errorf("column %s is part of the key", name)
+		}
+		cv, err := col.Value(v)
+		if err != nil {
+			return err
+		}
+		op.Data[name] = cv
+	}
+	if op.Op == "update" && len(op.Data) == 0 {
+		return fmt.Errorf("update sets no columns")
+	}
+	return nil
+}
+
+func (t *Table) isKey(name string) bool {
+	for _, k := range t.PrimaryKey {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Value converts v, decoded from JSON with UseNumber, to the Go value to bind
+// for the column. Integers must be integral numbers, DECIMAL values are kept
+// as their exact decimal text, JSON columns take any JSON value, and binary
+// columns {"base64": "..."} or a string of the bytes to store.
+func (c *Column) Value(v any) (any, error) {
+	if v == nil {
+		if !c.Nullable {
+			return nil, fmt.Errorf("column %s is not nullable", c.Name)
+		}
+		return nil, nil
+	}
+	switch c.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year", "bit":
+		if b, ok := v.(bool); ok && c.DataType == "tinyint" {
+			if b {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("column %s needs an integer", c.Name)
+		}
+		if c.Unsigned {
+			u, err := strconv.ParseUint(string(n), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %s needs an unsigned integer", c.Name)
+			}
+			return u, nil
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("column %s needs an integer", c.Name)
+		}
+		return i, nil
+	case "decimal", "numeric":
+		switch n := v.(type) {
+		case json.Number:
+			return string(n), nil
+		case string:
+			if _, err := strconv.ParseFloat(n, 64); err == nil {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("column %s needs a number", c.Name)
+	case "float", "double", "real":
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("column %s needs a number", c.Name)
+		}
+		return n.Float64()
+	case "json":
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	if c.binary() {
+		if b, ok := BytesValue(v); ok {
+			return Bytes(b), nil
+		}
+		if s, ok := v.(string); ok {
+			return Bytes(s), nil
+		}
+		return nil, fmt.Errorf("column %s needs {\"base64\": ...} or a string", c.Name)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("column %s needs a string", c.Name)
+	}
+	return s, nil
+}
+
+// Image replaces op's data with the row as q now sees it, so a segment
+// carries the values the owner stored, including defaults, ON UPDATE
+// timestamps and an auto-increment key, instead of expressions each replica
+// would evaluate differently. lastInsertID is that of op's own statement.
+// Deletes are left as they are.
+func (t *Table) Image(ctx context.Context, q Querier, op *RowOp, lastInsertID uint64) error {
+	if op.Op == "delete" {
+		return nil
+	}
+	for _, name := range t.PrimaryKey {
+		if _, ok := op.Key[name]; !ok {
+			var id any = int64(lastInsertID)
+			if t.byName[name].Unsigned {
+				id = lastInsertID
+			}
+			op.Key[name] = id
+		}
+	}
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = QuoteIdent(c.Name)
+	}
+	where, err := cols(op.Key)
+	if err != nil {
+		return err
+	}
+	var b builder
+	b.sb.WriteString("SELECT " + strings.Join(names, ", ") + " FROM " + QuoteIdent(t.Name) + " WHERE ")
+	b.list(where, " AND ", true)
+	st := b.stmt()
+	res, err := q.Query(ctx, st.SQL, st.Args...)
+	if err != nil {
+		return err
+	}
+	if len(res.Rows) == 0 {
+		return fmt.Errorf("%s %s: %w", op.Op, t.Name, ErrNoRow)
+	}
+	op.Data = make(map[string]any, len(t.Columns)-len(t.PrimaryKey))
+	for i, c := range t.Columns {
+		if !t.isKey(c.Name) {
+			op.Data[c.Name] = c.image(res.Rows[0][i])
+		}
+	}
+	return nil
+}
+
+// image converts a value read back from MySQL into one that survives the
+// trip through a JSON segment and binds back to the same stored value.
+func (c *Column) image(v any) any {
+	switch v := v.(type) {
+	case time.Time:
+		if c.DataType == "date" {
+			if v.IsZero() {
+				return "0000-00-00"
+			}
+			return v.Format("2006-01-02")
+		}
+		if v.IsZero() {
+			return "0000-00-00 00:00:00"
+		}
+		return v.Format("2006-01-02 15:04:05.999999")
+	case []byte:
+		if c.DataType == "bit" {
+			return bitValue(string(v))
+		}
+		if c.binary() {
+			return Bytes(v)
+		}
+		return string(v)
+	case string:
+		if c.DataType == "bit" {
+			return bitValue(v)
+		}
+		if c.binary() {
+			return Bytes(v)
+		}
+	}
+	return v
+}
+
+// binary reports whether the column holds bytes rather than text.
+func (c *Column) binary() bool {
+	switch c.DataType {
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		return true
+	}
+	return false
+}
+
+// bitValue reads a BIT value's big-endian bytes as a number.
+func bitValue(b string) uint64 {
+	var n uint64
+	for i := 0; i < len(b); i++ {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package sqlstmt
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTable(name string, key []string, cols ...Column) *Table {
+	t := &Table{Name: name, Columns: cols, PrimaryKey: key, byName: map[string]*Column{}}
+	for i := range t.Columns {
+		t.byName[t.Columns[i].Name] = &t.Columns[i]
+	}
+	return t
+}
+
+func TestCheck(t *testing.T) {
+	tbl := newTable("orders", []string{"id", "region"},
+		Column{Name: "id", DataType: "bigint", AutoIncrement: true},
+		Column{Name: "region", DataType: "varchar"},
+		Column{Name: "total", DataType: "decimal", Nullable: true},
+	)
+	for _, tc := range []struct {
+		name string
+		op   RowOp
+		err  string // "" if the op is valid
+	}{
+		{"valid", RowOp{Op: "update", Key: map[string]any{"id": json.Number("1"), "region": "eu"}, Data: map[string]any{"total": json.Number("1.50")}}, ""},
+		{"auto-increment left out", RowOp{Op: "insert", Key: map[string]any{"region": "eu"}}, ""},
+		{"unknown column", RowOp{Op: "update", Key: map[string]any{"id": json.Number("1"), "region": "eu"}, Data: map[string]any{"nope": "x"}}, "has no column nope"},
+		{"key column in data", RowOp{Op: "update", Key: map[string]any{"id": json.Number("1"), "region": "eu"}, Data: map[string]any{"region": "us"}}, "part of the key"},
+		{"null key column", RowOp{Op: "delete", Key: map[string]any{"id": json.Number("1"), "region": nil}}, "key column region is null"},
+		{"missing key column", RowOp{Op: "delete", Key: map[string]any{"id": json.Number("1")}}, "primary key columns"},
+		{"auto-increment left out of a delete", RowOp{Op: "delete", Key: map[string]any{"region": "eu"}}, "primary key columns"},
+		{"extra key column", RowOp{Op: "delete", Key: map[string]any{"id": json.Number("1"), "region": "eu", "total": json.Number("1")}}, "primary key columns"},
+		{"update without data", RowOp{Op: "update", Key: map[string]any{"id": json.Number("1"), "region": "eu"}}, "sets no columns"},
+	} {
+		err := tbl.Check(&tc.op)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestCheckConvertsValues(t *testing.T) {
+	tbl := newTable("t", []string{"id"},
+		Column{Name: "id", DataType: "bigint", Unsigned: true},
+		Column{Name: "total", DataType: "decimal"},
+	)
+	op := &RowOp{Op: "update", Key: map[string]any{"id": json.Number("18446744073709551615")}, Data: map[string]any{"total": json.Number("0.10")}}
+	if err := tbl.Check(op); err != nil {
+		t.Fatal(err)
+	}
+	want := &RowOp{Op: "update", Key: map[string]any{"id": uint64(18446744073709551615)}, Data: map[string]any{"total": "0.10"}}
+	if !reflect.DeepEqual(op, want) {
+		t.Errorf("got %+v, want %+v", op, want)
+	}
+}
+
+func TestColumnValue(t *testing.T) {
+	for _, tc := range []struct {
+		col  Column
+		in   any
+		want any
+		err  bool
+	}{
+		{Column{DataType: "int"}, json.Number("-5"), int64(-5), false},
+		{Column{DataType: "int"}, json.Number("1.5"), nil, true},
+		{Column{DataType: "int"}, "5", nil, true},
+		{Column{DataType: "bigint", Unsigned: true}, json.Number("18446744073709551615"), uint64(18446744073709551615), false},
+		{Column{DataType: "int", Unsigned: true}, json.Number("-1"), nil, true},
+		{Column{DataType: "tinyint"}, true, int64(1), false},
+		{Column{DataType: "tinyint"}, false, int64(0), false},
+		{Column{DataType: "int"}, true, nil, true},
+		{Column{DataType: "decimal"}, json.Number("12345678901234567890.000000001"), "12345678901234567890.000000001", false},
+		{Column{DataType: "decimal"}, "0.1", "0.1", false},
+		{Column{DataType: "decimal"}, "ten", nil, true},
+		{Column{DataType: "double"}, json.Number("0.5"), 0.5, false},
+		{Column{DataType: "json"}, map[string]any{"a": []any{json.Number("1"), "b"}}, `{"a":[1,"b"]}`, false},
+		{Column{DataType: "json"}, "s", `"s"`, false},
+		{Column{DataType: "varbinary"}, map[string]any{"base64": "/wCA/g=="}, Bytes{0xff, 0x00, 0x80, 0xfe}, false},
+		{Column{DataType: "blob"}, "ab", Bytes("ab"), false},
+		{Column{DataType: "varchar"}, json.Number("1"), nil, true},
+		{Column{DataType: "varchar", Nullable: true}, nil, nil, false},
+		{Column{DataType: "varchar"}, nil, nil, true},
+	} {
+		got, err := tc.col.Value(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%s %#v: error %v", tc.col.DataType, tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %#v: got %#v, want %#v", tc.col.DataType, tc.in, got, tc.want)
+		}
+	}
+}
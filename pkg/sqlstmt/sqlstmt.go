@@ -0,0 +1,170 @@
+// Package sqlstmt builds the DML statements the router and agents run. Table
+// and column names are quoted as identifiers and values are bound as
+// parameters, so nothing taken from a request or a segment is ever parsed as
+// SQL.
+package sqlstmt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Stmt is a statement with ? placeholders and the values bound to them.
+type Stmt struct {
+	SQL  string
+	Args []any
+}
+
+// Expr is a value written into the statement verbatim, such as NOW(). It must
+// only ever be a constant in code.
+type Expr string
+
+// Col is a column name and the value to write or match.
+type Col struct {
+	Name  string
+	Value any
+}
+
+// QuoteIdent quotes name as a MySQL identifier. A qualified name such as
+// db.table is quoted part by part.
+func QuoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = "`" + strings.ReplaceAll(p, "`", "``") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+type builder struct {
+	sb   strings.Builder
+	args []any
+}
+
+func (b *builder) value(v any) {
+	if e, ok := v.(Expr); ok {
+		b.sb.WriteString(string(e))
+		return
+	}
+	b.sb.WriteByte('?')
+	b.args = append(b.args, v)
+}
+
+func (b *builder) list(cols []Col, sep string, assign bool) {
+	for i, c := range cols {
+		if i > 0 {
+			b.sb.WriteString(sep)
+		}
+		b.sb.WriteString(QuoteIdent(c.Name))
+		if assign {
+			b.sb.WriteString(" = ")
+			b.value(c.Value)
+		}
+	}
+}
+
+func (b *builder) stmt() Stmt { return Stmt{SQL: b.sb.String(), Args: b.args} }
+
+// Insert builds INSERT INTO table (cols) VALUES (...).
+func Insert(table string, cols []Col) Stmt {
+	var b builder
+	b.sb.WriteString("INSERT INTO " + QuoteIdent(table) + " (")
+	b.list(cols, ", ", false)
+	b.sb.WriteString(") VALUES (")
+	for i, c := range cols {
+		if i > 0 {
+			b.sb.WriteString(", ")
+		}
+		b.value(c.Value)
+	}
+	b.sb.WriteString(")")
+	return b.stmt()
+}
+
+// Upsert builds an insert that overwrites the columns in update when the row
+// already exists.
+func Upsert(table string, cols []Col, update []string) Stmt {
+	st := Insert(table, cols)
+	var sb strings.Builder
+	sb.WriteString(st.SQL + " ON DUPLICATE KEY UPDATE ")
+	for i, name := range update {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		q := QuoteIdent(name)
+		sb.WriteString(q + " = VALUES(" + q + ")")
+	}
+	st.SQL = sb.String()
+	return st
+}
+
+// Update builds UPDATE table SET set WHERE where, the where columns joined
+// with AND.
+func Update(table string, set, where []Col) Stmt {
+	var b builder
+	b.sb.WriteString("UPDATE " + QuoteIdent(table) + " SET ")
+	b.list(set, ", ", true)
+	b.sb.WriteString(" WHERE ")
+	b.list(where, " AND ", true)
+	return b.stmt()
+}
+
+// Delete builds DELETE FROM table WHERE where, the where columns joined with
+// AND.
+func Delete(table string, where []Col) Stmt {
+	var b builder
+	b.sb.WriteString("DELETE FROM " + QuoteIdent(table) + " WHERE ")
+	b.list(where, " AND ", true)
+	return b.stmt()
+}
+
+// Bytes is the value of a binary or blob column. In a segment it is the JSON
+// object {"base64": "..."}, so bytes that are not valid UTF-8 arrive intact.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+// BytesValue returns the bytes of v, a Bytes value or one decoded from its
+// JSON form, and whether it is one.
+func BytesValue(v any) ([]byte, bool) {
+	switch v := v.(type) {
+	case Bytes:
+		return v, true
+	case map[string]any:
+		s, ok := v["base64"].(string)
+		if !ok || len(v) != 1 {
+			return nil, false
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		return b, err == nil
+	}
+	return nil, false
+}
+
+// JSONValue converts a value decoded from JSON with UseNumber into one that
+// can be bound: numbers become int64 (or uint64 above its range) when
+// integral and float64 otherwise, and binary values their bytes.
+// Values that are already bindable scalars pass through; other objects and
+// arrays are rejected.
+func JSONValue(v any) (any, error) {
+	if b, ok := BytesValue(v); ok {
+		return b, nil
+	}
+	switch v := v.(type) {
+	case nil, string, bool, int64, uint64, float64, []byte:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
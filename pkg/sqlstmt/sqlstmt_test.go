@@ -0,0 +1,79 @@
+package sqlstmt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"accounts", "`accounts`"},
+		{"demo.accounts", "`demo`.`accounts`"},
+		{"a`b", "`a``b`"},
+		{"`", "````"},
+		{"x` = 1; DROP TABLE t; -- ", "`x`` = 1; DROP TABLE t; -- `"},
+		{"a.b`.c", "`a`.`b```.`c`"},
+		{"a\x00b", "`a\x00b`"},
+		{"", "``"},
+	} {
+		if got := QuoteIdent(tc.name); got != tc.want {
+			t.Errorf("QuoteIdent(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	cols := []Col{{Name: "id", Value: int64(1)}, {Name: "name", Value: "a"}, {Name: "at", Value: Expr("NOW()")}}
+	key := []Col{{Name: "id", Value: int64(1)}, {Name: "k`2", Value: "b"}}
+	for _, tc := range []struct {
+		name string
+		got  Stmt
+		want Stmt
+	}{
+		{
+			"insert",
+			Insert("t", cols),
+			Stmt{"INSERT INTO `t` (`id`, `name`, `at`) VALUES (?, ?, NOW())", []any{int64(1), "a"}},
+		},
+		{
+			"upsert",
+			Upsert("db.t", cols, []string{"name", "at"}),
+			Stmt{"INSERT INTO `db`.`t` (`id`, `name`, `at`) VALUES (?, ?, NOW()) ON DUPLICATE KEY UPDATE `name` = VALUES(`name`), `at` = VALUES(`at`)", []any{int64(1), "a"}},
+		},
+		{
+			"update",
+			Update("t", []Col{{Name: "name", Value: "c"}, {Name: "n", Value: uint64(2)}}, key),
+			Stmt{"UPDATE `t` SET `name` = ?, `n` = ? WHERE `id` = ? AND `k``2` = ?", []any{"c", uint64(2), int64(1), "b"}},
+		},
+		{
+			"delete",
+			Delete("t", key),
+			Stmt{"DELETE FROM `t` WHERE `id` = ? AND `k``2` = ?", []any{int64(1), "b"}},
+		},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s:\n got %q %#v\nwant %q %#v", tc.name, tc.got.SQL, tc.got.Args, tc.want.SQL, tc.want.Args)
+		}
+	}
+}
+
+func TestStatementOrdersColumns(t *testing.T) {
+	op := &RowOp{Op: "update", Table: "t", Key: map[string]any{"id": int64(7)}, Data: map[string]any{"b": "x", "a": "y"}}
+	for _, tc := range []struct {
+		upsert bool
+		want   Stmt
+	}{
+		{false, Stmt{"UPDATE `t` SET `a` = ?, `b` = ? WHERE `id` = ?", []any{"y", "x", int64(7)}}},
+		{true, Stmt{"INSERT INTO `t` (`id`, `a`, `b`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `a` = VALUES(`a`), `b` = VALUES(`b`)", []any{int64(7), "y", "x"}}},
+	} {
+		got, err := op.Statement(tc.upsert)
+		if err != nil {
+			t.Fatalf("upsert %v: %v", tc.upsert, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("upsert %v:\n got %q %#v\nwant %q %#v", tc.upsert, got.SQL, got.Args, tc.want.SQL, tc.want.Args)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package sqlstmt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tables is the allow-list of tables each range may write. Tables listed
+// under the empty range ID are allowed for every range.
+type Tables map[string]map[string]bool
+
+// ParseTables parses an allow-list of the form
+// "range1=t1,t2;range2=t3". An entry without "range=" applies to every
+// range, so "accounts,orders" allows those two tables everywhere.
+func ParseTables(raw string) (Tables, error) {
+	out := Tables{}
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rangeID, list := "", entry
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			rangeID, list = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		if out[rangeID] == nil {
+			out[rangeID] = map[string]bool{}
+		}
+		for _, t := range strings.Split(list, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				out[rangeID][t] = true
+			}
+		}
+		if len(out[rangeID]) == 0 {
+			return nil, fmt.Errorf("tables: no tables for range %q", rangeID)
+		}
+	}
+	return out, nil
+}
+
+// Check returns an error unless rangeID may write table.
+func (t Tables) Check(rangeID, table string) error {
+	if t[rangeID][table] || t[""][table] {
+		return nil
+	}
+	return fmt.Errorf("table %q is not configured for range %s", table, rangeID)
+}
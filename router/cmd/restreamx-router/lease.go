@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"restreamx/pkg/api"
+)
+
+// errLeaseExpiring refuses a write under a lease that lapses within the
+// margin.
+var errLeaseExpiring = errors.New("lease is about to lapse")
+
+// cachedLease is a lease and the local time by which it has lapsed.
+type cachedLease struct {
+	lease    *api.Lease
+	deadline time.Time
+}
+
+// lease returns rangeID's lease, reading it from the ledger only when the
+// cached one is missing or within the margin of lapsing. The ledger still
+// rejects an append under a lease that has moved or lapsed, so the cache
+// saves a round trip per write without weakening the fence.
+func (r *router) lease(ctx context.Context, rangeID string) (*api.Lease, error) {
+	if c := r.cachedLease(rangeID); c != nil && time.Until(c.deadline) > r.cfg.LeaseMargin {
+		return c.lease, nil
+	}
+	atomic.AddUint64(&r.leaseLookups, 1)
+	lease, err := r.ledger.GetLease(ctx, rangeID)
+	if err != nil {
+		return nil, err
+	}
+	// The ledger's clock set the expiry; the margin absorbs the skew.
+	c := r.cacheLease(lease, time.UnixMilli(lease.ExpiryMs))
+	if left := time.Until(c.deadline); left <= r.cfg.LeaseMargin {
+		return nil, fmt.Errorf("%w: %s lapses in %s", errLeaseExpiring, rangeID, left.Round(time.Millisecond))
+	}
+	return c.lease, nil
+}
+
+func (r *router) cachedLease(rangeID string) *cachedLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leases[rangeID]
+}
+
+// cacheLease records lease unless a later epoch is cached already, and
+// returns the cached entry.
+func (r *router) cacheLease(lease *api.Lease, deadline time.Time) *cachedLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.leases[lease.RangeId]; c != nil && c.lease.Epoch > lease.Epoch {
+		return c
+	}
+	c := &cachedLease{lease: lease, deadline: deadline}
+	r.leases[lease.RangeId] = c
+	return c
+}
+
+// forgetLease drops rangeID's cached lease if it is still at epoch.
+func (r *router) forgetLease(rangeID string, epoch uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.leases[rangeID]; c != nil && c.lease.Epoch == epoch {
+		delete(r.leases, rangeID)
+	}
+}
+
+// leaseWatchWait is how long each lease watch waits for a change.
+const leaseWatchWait = 30 * time.Second
+
+// watchLoop feeds lease changes into the cache as the ledger makes them, so
+// a range another router or operator moves is written on its new owner
+// straight away rather than after a write fails against the old one.
+func (r *router) watchLoop() {
+	ids := make([]string, 0, len(r.ranges.ranges))
+	for _, kr := range r.ranges.ranges {
+		ids = append(ids, kr.ID)
+	}
+	var rev uint64
+	for {
+		leases, err := r.ledger.WatchLease(context.Background(), &api.WatchLeaseRequest{RangeIds: ids, AfterRevision: rev, WaitMs: leaseWatchWait.Milliseconds()})
+		if err != nil {
+			log.Printf("lease: watch: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, lease := range leases {
+			rev = max(rev, lease.Revision)
+			r.cacheLease(lease, time.UnixMilli(lease.ExpiryMs))
+		}
+	}
+}
+
+// probeTimeout bounds each owner probe and agent status request, so one node
+// that hangs cannot hold up renewing the others' leases.
+const probeTimeout = time.Second
+
+// leaseLoop keeps the ranges' leases alive. Every third of the lease TTL it
+// probes each owner's MySQL and renews the leases of owners that answer. An
+// owner that fails cfg.FailoverAfter probes in a row loses its ranges to the
+// reachable node whose agent has applied the most. The first check runs at
+// startup.
+func (r *router) leaseLoop() {
+	interval := r.cfg.LeaseTTL / 3
+	failures := map[string]int{}
+	modesStale := false
+	for ; ; time.Sleep(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		moved := r.checkLeases(ctx, failures)
+		if moved || modesStale {
+			// A failed owner cannot be switched to REPLICA until it is back,
+			// so keep trying.
+			err := r.updateModes(ctx)
+			if err != nil {
+				log.Printf("lease: update modes: %v", err)
+			}
+			modesStale = err != nil
+		}
+		cancel()
+	}
+}
+
+// checkLeases renews or fails over every assigned range and reports whether
+// any range changed owner. It falls back to the cached lease of a range the
+// ledger no longer reports: the ledger stops reporting a lease once it
+// expires, but it can still be renewed, or taken over, at its epoch. A lease
+// that expired before the router cached it, as across a restart, is adopted
+// from the ledger's last record of it. failures counts each owner's
+// consecutive failed probes across calls.
+func (r *router) checkLeases(ctx context.Context, failures map[string]int) bool {
+	healthy := map[string]bool{}
+	moved := false
+	for _, kr := range r.ranges.ranges {
+		lease, err := r.ledger.GetLease(ctx, kr.ID)
+		cached := r.cachedLease(kr.ID)
+		switch {
+		case err == nil:
+			lease = r.cacheLease(lease, time.UnixMilli(lease.ExpiryMs)).lease
+		case errors.Is(err, api.ErrLeaseNotFound) && cached != nil:
+			lease = cached.lease
+		case errors.Is(err, api.ErrLeaseNotFound):
+			if lease, err = r.lastLease(ctx, kr.ID); err != nil {
+				log.Printf("lease: %s: %v", kr.ID, err)
+				continue
+			}
+			if lease == nil {
+				// Never assigned.
+				continue
+			}
+			r.cacheLease(lease, time.UnixMilli(lease.ExpiryMs))
+			log.Printf("lease: adopted expired lease of %s held by %s at epoch %d", kr.ID, lease.OwnerId, lease.Epoch)
+		default:
+			log.Printf("lease: %s: %v", kr.ID, err)
+			continue
+		}
+		up, probed := healthy[lease.OwnerId]
+		if !probed {
+			err := r.probe(ctx, lease.OwnerId)
+			up = err == nil
+			healthy[lease.OwnerId] = up
+			if up {
+				failures[lease.OwnerId] = 0
+			} else {
+				failures[lease.OwnerId]++
+				log.Printf("lease: owner %s failed probe %d of %d: %v", lease.OwnerId, failures[lease.OwnerId], r.cfg.FailoverAfter, err)
+			}
+		}
+		if up {
+			start := time.Now()
+			renewed, err := r.ledger.RenewLease(ctx, &api.RenewLeaseRequest{RangeId: kr.ID, OwnerId: lease.OwnerId, Epoch: lease.Epoch, TtlMs: r.cfg.LeaseTTL.Milliseconds()})
+			if err != nil {
+				log.Printf("lease: renew %s: %v", kr.ID, err)
+				continue
+			}
+			r.cacheLease(renewed, start.Add(r.cfg.LeaseTTL))
+			continue
+		}
+		if failures[lease.OwnerId] < r.cfg.FailoverAfter {
+			continue
+		}
+		if r.failover(lease) {
+			moved = true
+		}
+	}
+	return moved
+}
+
+// lastLease returns rangeID's lease as the ledger last recorded it, expired
+// or not, or nil if the range has never had one.
+func (r *router) lastLease(ctx context.Context, rangeID string) (*api.Lease, error) {
+	leases, err := r.ledger.WatchLease(ctx, &api.WatchLeaseRequest{RangeIds: []string{rangeID}})
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range leases {
+		if lease.RangeId == rangeID {
+			return lease, nil
+		}
+	}
+	return nil, nil
+}
+
+// probe checks that node's MySQL answers.
+func (r *router) probe(ctx context.Context, node string) error {
+	host, ok := r.cfg.OwnerMap[node]
+	if !ok {
+		return fmt.Errorf("%s is missing from -owners", node)
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return r.pool(host, r.cfg.MySQLUser, r.cfg.MySQLPass, r.cfg.MySQLDB).Ping(ctx)
+}
+
+// failover moves lease's range to the most caught-up other node and reports
+// whether it did. The takeover presents the failed lease's epoch, so it
+// loses to anyone who moved the range first.
+func (r *router) failover(lease *api.Lease) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+	node, err := r.mostCaughtUp(ctx, lease.RangeId, lease.OwnerId)
+	if err != nil {
+		log.Printf("lease: cannot fail over %s from %s: %v", lease.RangeId, lease.OwnerId, err)
+		return false
+	}
+	start := time.Now()
+	next, err := r.ledger.AcquireLease(ctx, &api.AcquireLeaseRequest{RangeId: lease.RangeId, OwnerId: node, Epoch: lease.Epoch, TtlMs: r.cfg.LeaseTTL.Milliseconds()})
+	if err != nil {
+		log.Printf("lease: fail over %s to %s: %v", lease.RangeId, node, err)
+		return false
+	}
+	r.cacheLease(next, start.Add(r.cfg.LeaseTTL))
+	log.Printf("lease: failed %s over from %s to %s at epoch %d", lease.RangeId, lease.OwnerId, node, next.Epoch)
+	// The new owner may not have applied every segment yet.
+	r.needReconcile(lease.RangeId, fmt.Errorf("failed over to %s", node))
+	return true
+}
+
+// mostCaughtUp returns the node other than failed whose MySQL answers and
+// whose agent has applied rangeID the furthest, by its checkpoint there, and
+// between agents level on that the highest applied index.
+func (r *router) mostCaughtUp(ctx context.Context, rangeID, failed string) (string, error) {
+	nodes := make([]string, 0, len(r.cfg.Agents))
+	for node := range r.cfg.Agents {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	best, bestCheckpoint, bestIndex := "", uint64(0), uint64(0)
+	var reasons []string
+	for _, node := range nodes {
+		if node == failed {
+			continue
+		}
+		if err := r.probe(ctx, node); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", node, err))
+			continue
+		}
+		st, err := r.agentStatus(ctx, r.cfg.Agents[node])
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s agent: %v", node, err))
+			continue
+		}
+		cp := st.Checkpoints[rangeID]
+		if best == "" || cp > bestCheckpoint || cp == bestCheckpoint && st.AppliedIndex > bestIndex {
+			best, bestCheckpoint, bestIndex = node, cp, st.AppliedIndex
+		}
+	}
+	if best == "" {
+		if len(reasons) == 0 {
+			return "", fmt.Errorf("no other node is listed in -agents")
+		}
+		return "", fmt.Errorf("no healthy replica (%s)", strings.Join(reasons, "; "))
+	}
+	return best, nil
+}
+
+func (r *router) agentStatus(ctx context.Context, addr string) (*api.AgentStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var st api.AgentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
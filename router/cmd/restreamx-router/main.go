@@ -5,48 +5,70 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"os/exec"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"restreamx/pkg/api"
+	"restreamx/pkg/mysql"
+	"restreamx/pkg/sqlstmt"
 )
 
+const appendAttempts = 3
+
+// maxTxnOps bounds the operations in one /txn request.
+const maxTxnOps = 1000
+
+// reconcileWindow is how many of the owner's latest applied_segments rows
+// reconcile reads to find where the owner and the ledger may first differ;
+// it must exceed the writes that can be in flight at once.
+const reconcileWindow = 10000
+
+const reconcileTimeout = 5 * time.Minute
+
 type config struct {
 	LedgerAddr string
-	RangeID    string
 	OwnerMap   map[string]string
-	Timeout    time.Duration
-	MySQLUser  string
-	MySQLPass  string
-	MySQLDB    string
-	AdminUser  string
-	AdminPass  string
-}
-
-type writeRequest struct {
-	Op    string                 `json:"op"`
-	Table string                 `json:"table"`
-	ID    int                    `json:"id"`
-	Data  map[string]interface{} `json:"data"`
+	// Agents maps a node in OwnerMap to its agent's HTTP address.
+	Agents        map[string]string
+	FailoverAfter int
+	Timeout       time.Duration
+	LeaseTTL      time.Duration
+	LeaseMargin   time.Duration
+	MySQLUser     string
+	MySQLPass     string
+	MySQLDB       string
+	AdminUser     string
+	AdminPass     string
 }
 
 type router struct {
 	cfg        config
+	ranges     *rangeMap
 	ledger     *api.Client
 	writeCount uint64
+	// leaseLookups counts the ledger reads made because a write found no
+	// usable cached lease.
+	leaseLookups uint64
+
+	mu      sync.Mutex
+	pools   map[string]*mysql.Pool
+	schemas map[string]*sqlstmt.Table
+	leases  map[string]*cachedLease
 }
 
 func main() {
 	var listen = flag.String("listen", ":8080", "http listen")
 	var ledgerAddr = flag.String("ledger", "http://ledger1:7000", "ledger addr")
-	var rangeID = flag.String("range", "demo.accounts:FULL", "range")
+	var rangeID = flag.String("range", "demo.accounts:FULL", "range, when -ranges is empty")
+	var ranges = flag.String("ranges", "", "range map, as range=t1,t2;range=t3 (default: -range writing -tables)")
 	var ownerMap = flag.String("owners", "mysql1=mysql1:3306", "owner map")
 	var mysqlUser = flag.String("mysql-user", "restreamx_router", "mysql user")
 	var mysqlPass = flag.String("mysql-pass", "router", "mysql pass")
@@ -54,13 +76,42 @@ func main() {
 	var adminUser = flag.String("admin-user", "root", "admin user")
 	var adminPass = flag.String("admin-pass", "root", "admin pass")
 	var metrics = flag.String("metrics", ":8081", "metrics")
+	var leaseTTL = flag.Duration("lease-ttl", 30*time.Second, "lease ttl")
+	var leaseMargin = flag.Duration("lease-margin", 5*time.Second, "stop writing under a lease this long before it lapses")
+	var agents = flag.String("agents", "", "agent map, as node=http://agent:9090,...; failover picks among these nodes")
+	var failoverAfter = flag.Int("failover-after", 3, "failed owner probes, one per third of the lease ttl, before failover")
+	var tables = flag.String("tables", "accounts,orders", "tables -range writes, when -ranges is empty")
 	flag.Parse()
 
-	cfg := config{LedgerAddr: *ledgerAddr, RangeID: *rangeID, OwnerMap: parseOwnerMap(*ownerMap), Timeout: 5 * time.Second, MySQLUser: *mysqlUser, MySQLPass: *mysqlPass, MySQLDB: *mysqlDB, AdminUser: *adminUser, AdminPass: *adminPass}
-	r := &router{cfg: cfg, ledger: api.NewClient(*ledgerAddr, 5*time.Second)}
+	spec := *ranges
+	if spec == "" {
+		spec = *rangeID + "=" + *tables
+	}
+	allowed, err := sqlstmt.ParseTables(spec)
+	if err != nil {
+		log.Fatalf("-ranges: %v", err)
+	}
+	rm, err := parseRanges(allowed)
+	if err != nil {
+		log.Fatalf("-ranges: %v", err)
+	}
+	// Leases are renewed every third of the ttl, so they never have less
+	// than two thirds of it left while the owner is healthy.
+	if *leaseMargin >= *leaseTTL/2 {
+		log.Fatalf("-lease-margin %s must be under half of -lease-ttl %s", *leaseMargin, *leaseTTL)
+	}
+
+	cfg := config{LedgerAddr: *ledgerAddr, OwnerMap: parseOwnerMap(*ownerMap), Timeout: 5 * time.Second, LeaseTTL: *leaseTTL, LeaseMargin: *leaseMargin, MySQLUser: *mysqlUser, MySQLPass: *mysqlPass, MySQLDB: *mysqlDB, AdminUser: *adminUser, AdminPass: *adminPass, Agents: parseOwnerMap(*agents), FailoverAfter: *failoverAfter}
+	r := &router{cfg: cfg, ranges: rm, ledger: api.NewClient(*ledgerAddr, 5*time.Second), pools: map[string]*mysql.Pool{}, schemas: map[string]*sqlstmt.Table{}, leases: map[string]*cachedLease{}}
+	for _, kr := range rm.ranges {
+		go r.reconcileLoop(kr)
+	}
+	go r.leaseLoop()
+	go r.watchLoop()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/write", r.handleWrite)
+	mux.HandleFunc("/txn", r.handleTxn)
 	mux.HandleFunc("/admin/lease", r.handleLease)
 	mux.HandleFunc("/metrics", r.handleMetrics)
 
@@ -95,20 +146,65 @@ func (r *router) handleLease(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// Without a range the owner takes every range.
+	var ids []string
+	if id := req.URL.Query().Get("range"); id != "" {
+		if r.ranges.get(id) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("unknown range %s", id)))
+			return
+		}
+		ids = []string{id}
+	} else {
+		for _, kr := range r.ranges.ranges {
+			ids = append(ids, kr.ID)
+		}
+	}
 	ctx, cancel := context.WithTimeout(req.Context(), r.cfg.Timeout)
 	defer cancel()
-	lease, err := r.ledger.AcquireLease(ctx, &api.AcquireLeaseRequest{RangeId: r.cfg.RangeID, OwnerId: owner, TtlMs: 30000})
-	if err != nil {
+	leases := make([]*api.Lease, 0, len(ids))
+	for _, id := range ids {
+		start := time.Now()
+		acquire := &api.AcquireLeaseRequest{RangeId: id, OwnerId: owner, TtlMs: r.cfg.LeaseTTL.Milliseconds()}
+		// An operator handing the range to a new owner is an explicit
+		// takeover of whatever lease is current.
+		cur, err := r.ledger.GetLease(ctx, id)
+		switch {
+		case err == nil:
+			acquire.Epoch = cur.Epoch
+		case !errors.Is(err, api.ErrLeaseNotFound):
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		lease, err := r.ledger.AcquireLease(ctx, acquire)
+		if errors.Is(err, api.ErrLeaseConflict) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		r.cacheLease(lease, start.Add(r.cfg.LeaseTTL))
+		leases = append(leases, lease)
+	}
+	if err := r.updateModes(ctx); err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
-	if err := r.updateModes(owner); err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte(err.Error()))
+	// The new owner's agent may not have applied every segment yet.
+	for _, id := range ids {
+		r.needReconcile(id, fmt.Errorf("moved to %s", owner))
+	}
+	if len(leases) == 1 {
+		_ = json.NewEncoder(w).Encode(leases[0])
 		return
 	}
-	_ = json.NewEncoder(w).Encode(lease)
+	_ = json.NewEncoder(w).Encode(leases)
 }
 
 func (r *router) handleWrite(w http.ResponseWriter, req *http.Request) {
@@ -116,34 +212,109 @@ func (r *router) handleWrite(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	var wr writeRequest
-	if err := json.NewDecoder(req.Body).Decode(&wr); err != nil {
+	var op sqlstmt.RowOp
+	dec := json.NewDecoder(req.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&op); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.write(w, req, []sqlstmt.RowOp{op}, sqlstmt.PayloadJSON)
+}
+
+// handleTxn executes a list of operations in one owner transaction and
+// records them as a single segment.
+func (r *router) handleTxn(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var txn sqlstmt.Txn
+	dec := json.NewDecoder(req.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&txn); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(txn.Ops) == 0 || len(txn.Ops) > maxTxnOps {
 		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("a transaction needs 1 to %d ops", maxTxnOps)))
 		return
 	}
+	r.write(w, req, txn.Ops, sqlstmt.PayloadTxn)
+}
+
+// write runs ops on the range's owner and appends them as one segment of
+// payloadType.
+func (r *router) write(w http.ResponseWriter, req *http.Request, ops []sqlstmt.RowOp, payloadType string) {
 	ctx, cancel := context.WithTimeout(req.Context(), r.cfg.Timeout)
 	defer cancel()
-	lease, err := r.ledger.GetLease(ctx, r.cfg.RangeID)
-	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte("lease not found"))
-		return
+	var kr *keyRange
+	for i := range ops {
+		ops[i].Normalize()
+		ops[i].Op = strings.ToLower(ops[i].Op)
+		krs, err := r.ranges.candidates(ops[i].Table)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(opError(ops, i, err).Error()))
+			return
+		}
+		opRange := krs[0]
+		if len(krs) > 1 || !opRange.Full {
+			var status int
+			if opRange, status, err = r.splitRange(ctx, krs, &ops[i]); err != nil {
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(opError(ops, i, err).Error()))
+				return
+			}
+		}
+		if kr != nil && opRange != kr {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("op %d writes range %s but op 0 writes %s; a transaction must stay within one range", i, opRange.ID, kr.ID)))
+			return
+		}
+		kr = opRange
 	}
-	host, ok := r.cfg.OwnerMap[lease.OwnerId]
-	if !ok {
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte("owner missing"))
+	kr.fence.RLock()
+	defer kr.fence.RUnlock()
+	if atomic.LoadUint32(&kr.unreconciled) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(fmt.Sprintf("reconciling the owner of %s with the ledger", kr.ID)))
 		return
 	}
-	if err := r.executeTxn(host, &wr); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	lease, host, err := r.owner(ctx, kr.ID)
+	if err != nil {
+		w.WriteHeader(ownerStatus(err))
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
-	payload, _ := json.Marshal(wr)
-	seg := &api.Segment{RangeId: r.cfg.RangeID, Epoch: lease.Epoch, TxnId: newTxnID(), PayloadType: "json", PayloadBytes: payload}
-	if _, err := r.ledger.AppendSegment(ctx, seg); err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+	tbls := make([]*sqlstmt.Table, len(ops))
+	stmts := make([]sqlstmt.Stmt, len(ops))
+	for i := range ops {
+		tbls[i], stmts[i], err = r.buildWrite(ctx, host, &ops[i])
+		if err != nil {
+			w.WriteHeader(schemaStatus(err))
+			_, _ = w.Write([]byte(opError(ops, i, err).Error()))
+			return
+		}
+	}
+	seg := &api.Segment{RangeId: kr.ID, Epoch: lease.Epoch, TxnId: newTxnID(), PayloadType: payloadType}
+	if err := r.executeTxn(ctx, host, tbls, ops, stmts, seg); err != nil {
+		switch {
+		case errors.Is(err, sqlstmt.ErrNoRow):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, api.ErrStaleEpoch):
+			// The range moved or the lease lapsed since it was cached.
+			r.forgetLease(kr.ID, lease.Epoch)
+			w.WriteHeader(http.StatusConflict)
+		default:
+			if n := mysql.ErrorNumber(err); n == mysql.CodeBadField || n == mysql.CodeNoSuchTable {
+				for _, op := range ops {
+					r.forgetTable(op.Table)
+				}
+			}
+			w.WriteHeader(mysqlStatus(err))
+		}
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
@@ -151,41 +322,445 @@ func (r *router) handleWrite(w http.ResponseWriter, req *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func (r *router) executeTxn(host string, wr *writeRequest) error {
-	hostname, port := splitHostPort(host)
-	stmt := "START TRANSACTION;"
-	switch strings.ToLower(wr.Op) {
-	case "insert":
-		stmt += fmt.Sprintf("INSERT INTO %s (id, balance, updated_at) VALUES (%d, %v, NOW());", wr.Table, wr.ID, wr.Data["balance"])
-	case "update":
-		stmt += fmt.Sprintf("UPDATE %s SET balance=%v, updated_at=NOW() WHERE id=%d;", wr.Table, wr.Data["balance"], wr.ID)
-	case "delete":
-		stmt += fmt.Sprintf("DELETE FROM %s WHERE id=%d;", wr.Table, wr.ID)
+// opError prefixes err with the failing op's position when there are
+// several.
+func opError(ops []sqlstmt.RowOp, i int, err error) error {
+	if len(ops) == 1 {
+		return err
+	}
+	return fmt.Errorf("op %d: %w", i, err)
+}
+
+// splitRange returns the range among krs, the ranges of a split table, that
+// owns op's row, or the status to answer with. The table is split by the
+// value of its first primary key column. Until the router has its schema,
+// each key column in turn is taken to be that one, and the schema is read
+// from the owner of the range the column's value picks.
+func (r *router) splitRange(ctx context.Context, krs []*keyRange, op *sqlstmt.RowOp) (*keyRange, int, error) {
+	r.mu.Lock()
+	t := r.schemas[op.Table]
+	r.mu.Unlock()
+	if t == nil {
+		cols := make([]string, 0, len(op.Key))
+		for col := range op.Key {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			kr, err := pick(krs, op.Table, col, op.Key[col])
+			if err != nil {
+				continue
+			}
+			_, host, err := r.owner(ctx, kr.ID)
+			if err != nil {
+				return nil, ownerStatus(err), err
+			}
+			if t, err = r.table(ctx, host, op.Table); err != nil {
+				return nil, schemaStatus(err), err
+			}
+			break
+		}
+		if t == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("%s is split into ranges by its first primary key column, so the key must have it as an integer", op.Table)
+		}
+	}
+	col := t.PrimaryKey[0]
+	kr, err := pick(krs, op.Table, col, op.Key[col])
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return kr, 0, nil
+}
+
+// appendSegment appends seg, retrying failures that leave the outcome
+// unknown. The ledger dedupes on the segment's txn_id, so a retry of an
+// append that did land returns the original commit index.
+func (r *router) appendSegment(ctx context.Context, seg *api.Segment) (*api.AppendSegmentResponse, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := r.ledger.AppendSegment(ctx, seg)
+		var apiErr *api.Error
+		if err == nil || (errors.As(err, &apiErr) && apiErr.Code != api.CodeNotLeader) || attempt == appendAttempts {
+			return resp, err
+		}
+		log.Printf("append %s attempt %d: %v", seg.TxnId, attempt, err)
+		select {
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// pool returns the connection pool for user and db on the MySQL server at
+// addr.
+func (r *router) pool(addr, user, pass, db string) *mysql.Pool {
+	key := user + "@" + addr + "/" + db
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pools[key]
+	if !ok {
+		p = mysql.NewPool(mysql.Config{Addr: addr, User: user, Password: pass, Database: db, Timeout: r.cfg.Timeout}, 0, 0)
+		r.pools[key] = p
+	}
+	return p
+}
+
+// mysqlStatus maps a failed write to a response status: constraint
+// violations are the client's conflict, other server errors are ours, and
+// anything else means the owner could not be reached.
+func mysqlStatus(err error) int {
+	var me *mysql.Error
+	if !errors.As(err, &me) {
+		return http.StatusBadGateway
+	}
+	if me.Number == mysql.CodeDupEntry || strings.HasPrefix(me.SQLState, "23") {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// schemaStatus maps a failure to read a table's schema or validate a write
+// against it: MySQL being unreachable or failing is ours, anything else the
+// client's.
+func schemaStatus(err error) int {
+	if mysql.ErrorNumber(err) != 0 || errors.Is(err, mysql.ErrBadConn) {
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
+
+// ownerStatus maps a failure to find a range's owner to a response status:
+// a lease about to lapse is renewed or failed over shortly, anything else
+// means the ledger could not tell.
+func ownerStatus(err error) int {
+	if errors.Is(err, errLeaseExpiring) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// owner returns rangeID's lease and the address of its owner.
+func (r *router) owner(ctx context.Context, rangeID string) (*api.Lease, string, error) {
+	lease, err := r.lease(ctx, rangeID)
+	if err != nil {
+		return nil, "", fmt.Errorf("lease for %s: %w", rangeID, err)
+	}
+	host, ok := r.cfg.OwnerMap[lease.OwnerId]
+	if !ok {
+		return nil, "", fmt.Errorf("owner %s of %s is missing from -owners", lease.OwnerId, rangeID)
+	}
+	return lease, host, nil
+}
+
+// buildWrite validates op against the table's schema, converting its values
+// to the column types, and builds its statement.
+func (r *router) buildWrite(ctx context.Context, host string, op *sqlstmt.RowOp) (*sqlstmt.Table, sqlstmt.Stmt, error) {
+	t, err := r.table(ctx, host, op.Table)
+	if err != nil {
+		return nil, sqlstmt.Stmt{}, err
+	}
+	if err := t.Check(op); err != nil {
+		return nil, sqlstmt.Stmt{}, err
+	}
+	stmt, err := op.Statement(false)
+	return t, stmt, err
+}
+
+// table returns the schema of a table in the router's database, reading it
+// from the owner at host the first time.
+func (r *router) table(ctx context.Context, host, name string) (*sqlstmt.Table, error) {
+	r.mu.Lock()
+	t, ok := r.schemas[name]
+	r.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+	t, err := sqlstmt.LoadTable(ctx, r.pool(host, r.cfg.MySQLUser, r.cfg.MySQLPass, r.cfg.MySQLDB), r.cfg.MySQLDB, name)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.schemas[name] = t
+	r.mu.Unlock()
+	return t, nil
+}
+
+// forgetTable drops a cached schema after MySQL reports it out of date.
+func (r *router) forgetTable(name string) {
+	r.mu.Lock()
+	delete(r.schemas, name)
+	r.mu.Unlock()
+}
+
+// executeTxn runs stmts in one transaction on the owner and, after each,
+// reads its row back into the op so the segment records what the owner
+// stored. The segment is appended before the transaction commits, so the
+// owner never commits a write the ledger does not have. Its applied_segments
+// row is written before the append, with the commit index filled in after:
+// the owner's agent, which may see the segment before the commit, then waits
+// on that row instead of locking the gap it would go into. When the append's
+// outcome is unknown, or the commit fails after it, the ledger may hold a
+// write the owner rolled back; writes then stop until reconcile has replayed
+// it.
+func (r *router) executeTxn(ctx context.Context, host string, tbls []*sqlstmt.Table, ops []sqlstmt.RowOp, stmts []sqlstmt.Stmt, seg *api.Segment) error {
+	tx, err := r.pool(host, r.cfg.MySQLUser, r.cfg.MySQLPass, r.cfg.MySQLDB).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for i, stmt := range stmts {
+		res, err := tx.Exec(ctx, stmt.SQL, stmt.Args...)
+		if err != nil {
+			return opError(ops, i, err)
+		}
+		if err := tbls[i].Image(ctx, tx, &ops[i], res.LastInsertID); err != nil {
+			return opError(ops, i, err)
+		}
+	}
+	if seg.PayloadType == sqlstmt.PayloadTxn {
+		seg.PayloadBytes, _ = json.Marshal(&sqlstmt.Txn{Ops: ops})
+	} else {
+		seg.PayloadBytes, _ = json.Marshal(&ops[0])
+	}
+	seg.Seal()
+	mark := sqlstmt.MarkApplied(seg.RangeId, seg.Epoch, seg.TxnId, 0)
+	if _, err := tx.Exec(ctx, mark.SQL, mark.Args...); err != nil {
+		return err
+	}
+	resp, err := r.appendSegment(ctx, seg)
+	if err != nil {
+		var apiErr *api.Error
+		if !errors.As(err, &apiErr) || apiErr.Code == api.CodeNotLeader {
+			r.needReconcile(seg.RangeId, fmt.Errorf("append %s: %w", seg.TxnId, err))
+		}
+		return err
+	}
+	mark = sqlstmt.MarkApplied(seg.RangeId, seg.Epoch, seg.TxnId, resp.CommitIndex)
+	if _, err := tx.Exec(ctx, mark.SQL, mark.Args...); err != nil {
+		r.needReconcile(seg.RangeId, fmt.Errorf("record %s: %w", seg.TxnId, err))
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		r.needReconcile(seg.RangeId, fmt.Errorf("commit %s: %w", seg.TxnId, err))
+		return err
+	}
+	return nil
+}
+
+// needReconcile stops writes to rangeID until its reconcileLoop has brought
+// the owner up to date with the ledger.
+func (r *router) needReconcile(rangeID string, cause error) {
+	log.Printf("owner of %s may be behind the ledger: %v", rangeID, cause)
+	kr := r.ranges.get(rangeID)
+	atomic.StoreUint32(&kr.unreconciled, 1)
+	select {
+	case kr.reconcileNow <- struct{}{}:
 	default:
-		return fmt.Errorf("unknown op")
 	}
-	stmt += "COMMIT;"
-	return execMySQL(hostname, port, r.cfg.MySQLUser, r.cfg.MySQLPass, r.cfg.MySQLDB, stmt)
 }
 
-func (r *router) updateModes(owner string) error {
+// reconcileLoop runs reconcileRange on kr, with the range's writes stopped,
+// until it succeeds each time needReconcile is called for it, and once at
+// startup. Each range has its own loop, so an owner that cannot be reached
+// holds up only the ranges it owns.
+func (r *router) reconcileLoop(kr *keyRange) {
+	for {
+		if atomic.LoadUint32(&kr.unreconciled) != 0 {
+			kr.fence.Lock()
+			ctx, cancel := context.WithTimeout(context.Background(), reconcileTimeout)
+			err := r.reconcileRange(ctx, kr.ID)
+			cancel()
+			if err == nil {
+				atomic.StoreUint32(&kr.unreconciled, 0)
+			}
+			kr.fence.Unlock()
+			if err != nil {
+				log.Printf("reconcile %s: %v", kr.ID, err)
+				time.Sleep(time.Second)
+				continue
+			}
+		}
+		<-kr.reconcileNow
+	}
+}
+
+// reconcileRange replays onto the owner every segment of the range it has
+// not committed: one whose append the router saw fail although it landed, or
+// whose owner transaction failed after the append. Writes committed on the
+// owner after such a segment may have touched the same rows, so from the
+// first missing segment on the rest of the range is replayed in ledger order.
+// The segments carry row images, so replaying one the owner has is harmless.
+// If the segments the owner has not recorded reach back past the ledger's
+// compaction, it cannot be reconciled and must be re-seeded.
+func (r *router) reconcileRange(ctx context.Context, rangeID string) error {
+	lease, host, err := r.owner(ctx, rangeID)
+	if errors.Is(err, api.ErrLeaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db := r.pool(host, r.cfg.MySQLUser, r.cfg.MySQLPass, r.cfg.MySQLDB)
+	res, err := db.Query(ctx, "SELECT txn_id, commit_index FROM "+sqlstmt.AppliedTable+" WHERE range_id = ? ORDER BY commit_index DESC LIMIT ?", rangeID, reconcileWindow)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool, len(res.Rows))
+	recorded := make(map[uint64]bool, len(res.Rows))
+	for _, row := range res.Rows {
+		txnID, _ := row[0].(string)
+		ci, _ := row[1].(int64)
+		done[txnID], recorded[uint64(ci)] = true, true
+	}
+	// Below a full window the owner is taken to be complete.
+	from := uint64(1)
+	if len(res.Rows) == reconcileWindow {
+		ci, _ := res.Rows[len(res.Rows)-1][1].(int64)
+		from = uint64(ci)
+	}
+	// compacted is set once the window reaches below the compaction
+	// watermark, where the ledger can no longer show what the owner lacks.
+	var compacted uint64
+	replayed := 0
+	for {
+		segs, err := r.ledger.Subscribe(ctx, &api.SubscribeRequest{FromCommitIndex: from, RangeIds: []string{rangeID}, Limit: 500})
+		if errors.Is(err, api.ErrCompacted) {
+			st, err := r.ledger.Status(ctx)
+			if err != nil {
+				return err
+			}
+			from, compacted = st.CompactedIndex, st.CompactedIndex
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(segs) == 0 {
+			break
+		}
+		for _, seg := range segs {
+			from = seg.CommitIndex + 1
+			if compacted != 0 {
+				// The segment before the first readable one must be on the
+				// owner, or the owner may lack segments only a replica has.
+				if prev := seg.PrevCommitIndex; prev != 0 && prev < compacted && !recorded[prev] {
+					return fmt.Errorf("segment %d, before %d, is compacted and %s has not recorded it; re-seed it from a replica", prev, seg.CommitIndex, lease.OwnerId)
+				}
+				compacted = 0
+			}
+			if replayed == 0 && done[seg.TxnId] {
+				continue
+			}
+			if err := r.replay(ctx, db, seg); err != nil {
+				return fmt.Errorf("segment %d: %w", seg.CommitIndex, err)
+			}
+			replayed++
+		}
+	}
+	if replayed > 0 {
+		log.Printf("reconcile: replayed %d segments of %s on %s", replayed, rangeID, lease.OwnerId)
+	}
+	return nil
+}
+
+// replay applies seg's row images and its applied_segments row on db.
+func (r *router) replay(ctx context.Context, db *mysql.Pool, seg *api.Segment) error {
+	if err := seg.VerifyChecksum(); err != nil {
+		return err
+	}
+	ops, err := sqlstmt.DecodePayload(seg.PayloadType, seg.PayloadBytes)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, op := range ops {
+		if kr := r.ranges.get(seg.RangeId); kr == nil || !kr.Tables[op.Table] {
+			return fmt.Errorf("table %q is not configured for range %s", op.Table, seg.RangeId)
+		}
+		stmt, err := op.Statement(true)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, stmt.SQL, stmt.Args...); err != nil {
+			return err
+		}
+	}
+	mark := sqlstmt.MarkApplied(seg.RangeId, seg.Epoch, seg.TxnId, seg.CommitIndex)
+	if _, err := tx.Exec(ctx, mark.SQL, mark.Args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// updateModes fences each node by the ranges it owns. A node that owns none
+// is put in REPLICA mode. One that owns some is put in OWNER mode, and
+// restreamx.replica_tables lists the tables it owns no part of, whose writes
+// the plugin still refuses. The plugin sees only table names, so between the
+// intervals of a split table the router alone keeps writes apart.
+func (r *router) updateModes(ctx context.Context) error {
+	owned := map[string]map[string]bool{} // node -> tables it owns some of
+	for _, kr := range r.ranges.ranges {
+		lease, err := r.ledger.GetLease(ctx, kr.ID)
+		if errors.Is(err, api.ErrLeaseNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if owned[lease.OwnerId] == nil {
+			owned[lease.OwnerId] = map[string]bool{}
+		}
+		for t := range kr.Tables {
+			owned[lease.OwnerId][t] = true
+		}
+	}
+	// A node that is down must not keep the others from being updated.
+	var errs []error
 	for node, host := range r.cfg.OwnerMap {
-		hostname, port := splitHostPort(host)
 		mode := "REPLICA"
-		if node == owner {
+		if owned[node] != nil {
 			mode = "OWNER"
 		}
-		stmt := fmt.Sprintf("SET GLOBAL restreamx.mode='%s'; SET GLOBAL restreamx.node_id='%s';", mode, node)
-		if err := execMySQL(hostname, port, r.cfg.AdminUser, r.cfg.AdminPass, "mysql", stmt); err != nil {
-			return err
+		var replica []string
+		for t := range r.ranges.byTable {
+			if !owned[node][t] {
+				replica = append(replica, t)
+			}
+		}
+		sort.Strings(replica)
+		db := r.pool(host, r.cfg.AdminUser, r.cfg.AdminPass, "mysql")
+		// Fencing the tables first keeps a node becoming OWNER from taking
+		// writes to the others in between.
+		if _, err := db.Exec(ctx, "SET GLOBAL restreamx.replica_tables = ?", strings.Join(replica, ",")); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+			continue
+		}
+		if _, err := db.Exec(ctx, "SET GLOBAL restreamx.mode = ?", mode); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+			continue
+		}
+		if _, err := db.Exec(ctx, "SET GLOBAL restreamx.node_id = ?", node); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func (r *router) handleMetrics(w http.ResponseWriter, _ *http.Request) {
 	count := atomic.LoadUint64(&r.writeCount)
+	reconciling := 0
+	for _, kr := range r.ranges.ranges {
+		if atomic.LoadUint32(&kr.unreconciled) != 0 {
+			reconciling++
+		}
+	}
 	_, _ = fmt.Fprintf(w, "router_write_total %d\n", count)
+	_, _ = fmt.Fprintf(w, "router_reconciling %d\n", reconciling)
+	_, _ = fmt.Fprintf(w, "router_lease_lookups_total %d\n", atomic.LoadUint64(&r.leaseLookups))
 }
 
 func newTxnID() string {
@@ -193,29 +768,3 @@ func newTxnID() string {
 	_, _ = rand.Read(buf)
 	return hex.EncodeToString(buf)
 }
-
-func splitHostPort(addr string) (string, int) {
-	parts := strings.Split(addr, ":")
-	if len(parts) == 2 {
-		port, _ := strconv.Atoi(parts[1])
-		return parts[0], port
-	}
-	return addr, 3306
-}
-
-func execMySQL(host string, port int, user, pass, db, statement string) error {
-	args := []string{"-h", host, "-P", strconv.Itoa(port), "-u", user}
-	if pass != "" {
-		args = append(args, "-p"+pass)
-	}
-	if db != "" {
-		args = append(args, db)
-	}
-	args = append(args, "-e", statement)
-	cmd := exec.Command("mysql", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mysql exec: %s", string(out))
-	}
-	return nil
-}
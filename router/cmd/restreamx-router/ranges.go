@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"restreamx/pkg/sqlstmt"
+)
+
+// keyRange is one range of the range map: the tables it writes and, unless
+// it covers them whole, the interval of the first primary key column it owns
+// in each of them.
+type keyRange struct {
+	ID     string
+	Tables map[string]bool
+	Full   bool
+	Lo, Hi int64 // inclusive
+
+	// fence is held shared by the range's writes and exclusively by its
+	// reconcile, which runs while unreconciled is set.
+	fence        sync.RWMutex
+	unreconciled uint32
+	reconcileNow chan struct{}
+}
+
+// rangeMap routes row operations to ranges.
+type rangeMap struct {
+	ranges  []*keyRange // sorted by ID
+	byTable map[string][]*keyRange
+}
+
+// parseRanges builds the range map from the same range=t1,t2;range=t3 syntax
+// as -tables. A range ID ending in :lo-hi (or :lo- for no upper bound) owns
+// first-key values lo through hi of its tables; any other suffix, such as
+// :FULL, owns the tables whole.
+func parseRanges(tables sqlstmt.Tables) (*rangeMap, error) {
+	m := &rangeMap{byTable: map[string][]*keyRange{}}
+	for id, names := range tables {
+		if id == "" {
+			return nil, fmt.Errorf("ranges: tables %s have no range", joinSet(names))
+		}
+		// Every range is reconciled at startup.
+		kr := &keyRange{ID: id, Tables: names, Full: true, unreconciled: 1, reconcileNow: make(chan struct{}, 1)}
+		if i := strings.LastIndex(id, ":"); i >= 0 {
+			if lo, hi, ok := parseInterval(id[i+1:]); ok {
+				kr.Full, kr.Lo, kr.Hi = false, lo, hi
+			}
+		}
+		m.ranges = append(m.ranges, kr)
+		for t := range names {
+			m.byTable[t] = append(m.byTable[t], kr)
+		}
+	}
+	sort.Slice(m.ranges, func(i, j int) bool { return m.ranges[i].ID < m.ranges[j].ID })
+	for t, krs := range m.byTable {
+		sort.Slice(krs, func(i, j int) bool { return krs[i].Lo < krs[j].Lo })
+		for i, kr := range krs {
+			if kr.Full && len(krs) > 1 {
+				return nil, fmt.Errorf("ranges: %s covers %s whole but %d ranges list it", kr.ID, t, len(krs))
+			}
+			if i > 0 && kr.Lo <= krs[i-1].Hi {
+				return nil, fmt.Errorf("ranges: %s and %s overlap on %s", krs[i-1].ID, kr.ID, t)
+			}
+		}
+	}
+	return m, nil
+}
+
+func parseInterval(s string) (int64, int64, bool) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	l, err := strconv.ParseInt(lo, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	h := int64(math.MaxInt64)
+	if hi != "" {
+		if h, err = strconv.ParseInt(hi, 10, 64); err != nil || h < l {
+			return 0, 0, false
+		}
+	}
+	return l, h, true
+}
+
+func joinSet(set map[string]bool) string {
+	names := make([]string, 0, len(set))
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// get returns the range with the given ID, or nil.
+func (m *rangeMap) get(id string) *keyRange {
+	for _, kr := range m.ranges {
+		if kr.ID == id {
+			return kr
+		}
+	}
+	return nil
+}
+
+// candidates returns the ranges that write table.
+func (m *rangeMap) candidates(table string) ([]*keyRange, error) {
+	krs := m.byTable[table]
+	if len(krs) == 0 {
+		return nil, fmt.Errorf("table %q is not in any range", table)
+	}
+	return krs, nil
+}
+
+// pick returns the range among krs owning key, the value of the table's
+// first primary key column.
+func pick(krs []*keyRange, table, column string, key any) (*keyRange, error) {
+	if len(krs) == 1 && krs[0].Full {
+		return krs[0], nil
+	}
+	var n int64
+	var err error
+	switch v := key.(type) {
+	case json.Number:
+		n, err = v.Int64()
+	case int64:
+		n = v
+	case nil:
+		return nil, fmt.Errorf("%s is split into ranges by %s, so the key must have it", table, column)
+	default:
+		err = fmt.Errorf("not an integer")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is split into ranges by %s, so it must be an integer", table, column)
+	}
+	for _, kr := range krs {
+		if n >= kr.Lo && n <= kr.Hi {
+			return kr, nil
+		}
+	}
+	return nil, fmt.Errorf("no range owns %s %s = %d", table, column, n)
+}